@@ -0,0 +1,483 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// ErrCoreClosed is returned when writing to the closed AsyncCore.
+var ErrCoreClosed = errors.New("zapmsgpack: async core is closed")
+
+// AsyncCore defaults.
+const (
+	DefaultQueueSize     = 4096
+	DefaultFlushBytes    = 64 * 1024
+	DefaultFlushEntries  = 1024
+	DefaultFlushInterval = time.Second
+)
+
+// OverflowPolicy defines AsyncCore behavior when the queue is full.
+//
+// Entries dropped due to the overflow are counted (see AsyncCore.Dropped), and
+// once the queue has room again, "N logs dropped" warning is written.
+type OverflowPolicy int
+
+// Overflow policies.
+const (
+	// OverflowBlock blocks the caller until there's room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the new entry.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest entry in the queue to make room
+	// for the new entry.
+	OverflowDropOldest
+	// OverflowDropBelow drops the new entry if it's below AsyncConfig.DropLevel,
+	// other entries block the caller.
+	OverflowDropBelow
+)
+
+// AsyncConfig configures AsyncCore.
+//
+// Zero values are replaced with defaults.
+type AsyncConfig struct {
+	// QueueSize is the capacity of the queue of encoded entries, Overflow
+	// policy is applied when the queue is full.
+	QueueSize int
+	// Overflow is the policy applied to new entries when the queue is full,
+	// OverflowBlock by default.
+	Overflow OverflowPolicy
+	// DropLevel is the level of entries which are never dropped with
+	// OverflowDropBelow policy, InfoLevel by default. Entries of ErrorLevel and
+	// above are never dropped.
+	DropLevel zapcore.Level
+	// FlushBytes is the size of entries written since the last flush which
+	// triggers the flush.
+	FlushBytes int
+	// FlushEntries is the number of entries written since the last flush
+	// which triggers the flush.
+	FlushEntries int
+	// FlushInterval is the maximum time entry waits for the flush.
+	FlushInterval time.Duration
+}
+
+func (cfg *AsyncConfig) setDefaults() {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+
+	if cfg.FlushBytes <= 0 {
+		cfg.FlushBytes = DefaultFlushBytes
+	}
+
+	if cfg.FlushEntries <= 0 {
+		cfg.FlushEntries = DefaultFlushEntries
+	}
+
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+}
+
+// AsyncCore is zapcore.Core which writes entries in the background.
+//
+// Entries are encoded in the calling goroutine and put into the bounded queue.
+// Background goroutine writes entries to the WriteSyncer and flushes (calls
+// Sync) it when FlushBytes, FlushEntries or FlushInterval threshold is reached.
+//
+// AsyncCore is supposed to be used with Client, which batches the entries
+// into forward protocol messages, and sends them to fluentd on Sync.
+type AsyncCore struct {
+	zapcore.LevelEnabler
+
+	enc zapcore.Encoder
+	w   *asyncWriter
+}
+
+// NewAsyncCore creates AsyncCore and starts background goroutine.
+//
+// AsyncCore should be closed to stop the goroutine.
+func NewAsyncCore(enc zapcore.Encoder, out zapcore.WriteSyncer, enab zapcore.LevelEnabler, cfg AsyncConfig) *AsyncCore {
+	cfg.setDefaults()
+
+	w := newAsyncWriter(enc, out, cfg)
+
+	go w.run()
+
+	return &AsyncCore{
+		LevelEnabler: enab,
+		enc:          enc,
+		w:            w,
+	}
+}
+
+// With adds structured context to the Core, copy shares the queue with the
+// original.
+func (c *AsyncCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &AsyncCore{
+		LevelEnabler: c.LevelEnabler,
+		enc:          c.enc.Clone(),
+		w:            c.w,
+	}
+
+	for i := range fields {
+		fields[i].AddTo(clone.enc)
+	}
+
+	return clone
+}
+
+// Check determines whether the supplied Entry should be logged.
+func (c *AsyncCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+
+	return ce
+}
+
+// Write encodes the entry and puts it into the queue.
+//
+// Entries above ErrorLevel are flushed immediately, as the process is likely
+// to exit.
+func (c *AsyncCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+
+	if err = c.w.enqueue(asyncItem{buf: buf, level: ent.Level}); err != nil {
+		buf.Free()
+
+		return err
+	}
+
+	if ent.Level > zapcore.ErrorLevel {
+		// Since we may be crashing the program, sync the output.
+		return c.Sync()
+	}
+
+	return nil
+}
+
+// Sync blocks until all the queued entries are written, and flushes the WriteSyncer.
+//
+// Errors of the writes and flushes since the last Sync are returned.
+func (c *AsyncCore) Sync() error {
+	done := make(chan error, 1)
+
+	if err := c.w.enqueue(asyncItem{done: done}); err != nil {
+		return err
+	}
+
+	return <-done
+}
+
+// Dropped returns the number of entries dropped due to the queue overflow.
+func (c *AsyncCore) Dropped() uint64 {
+	return c.w.droppedCount()
+}
+
+// Close flushes queued entries and stops background goroutine.
+//
+// WriteSyncer is not closed.
+func (c *AsyncCore) Close() error {
+	return c.w.close()
+}
+
+// asyncItem is either encoded entry or Sync request.
+type asyncItem struct {
+	buf   *buffer.Buffer
+	level zapcore.Level
+	done  chan error
+}
+
+// asyncWriter writes queued entries to the WriteSyncer.
+type asyncWriter struct {
+	cfg AsyncConfig
+	enc zapcore.Encoder
+	out zapcore.WriteSyncer
+
+	mu sync.Mutex
+	// items are entries and Sync requests, only entries are counted
+	// against the queue size
+	items   []asyncItem
+	entries int
+	// notFull is signaled when entries are taken from the queue
+	notFull *sync.Cond
+	closed  bool
+	// dropped entries, total and not yet reported
+	dropped        uint64
+	droppedPending uint64
+
+	// wake is signaled when items are added
+	wake chan struct{}
+	done chan struct{}
+	err  error
+}
+
+func newAsyncWriter(enc zapcore.Encoder, out zapcore.WriteSyncer, cfg AsyncConfig) *asyncWriter {
+	w := &asyncWriter{
+		cfg:  cfg,
+		enc:  enc,
+		out:  out,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	w.notFull = sync.NewCond(&w.mu)
+
+	return w
+}
+
+// enqueue puts the item into the queue, overflow policy is applied to entries
+// if the queue is full.
+func (w *asyncWriter) enqueue(item asyncItem) error {
+	w.mu.Lock()
+
+	if item.done == nil {
+		for !w.closed && w.entries >= w.cfg.QueueSize {
+			if w.overflow(item) {
+				w.mu.Unlock()
+
+				return nil
+			}
+		}
+	}
+
+	if w.closed {
+		w.mu.Unlock()
+
+		return ErrCoreClosed
+	}
+
+	w.items = append(w.items, item)
+
+	if item.done == nil {
+		w.entries++
+	}
+
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// overflow applies overflow policy to the item when the queue is full.
+//
+// It returns true if the item was dropped. Should be called with w.mu held.
+func (w *asyncWriter) overflow(item asyncItem) bool {
+	switch w.cfg.Overflow {
+	case OverflowDropNewest:
+		w.drop(item)
+
+		return true
+	case OverflowDropOldest:
+		for i := range w.items {
+			if w.items[i].done == nil {
+				w.drop(w.items[i])
+
+				w.items = append(w.items[:i], w.items[i+1:]...)
+				w.entries--
+
+				return false
+			}
+		}
+	case OverflowDropBelow:
+		if item.level < w.cfg.DropLevel && item.level < zapcore.ErrorLevel {
+			w.drop(item)
+
+			return true
+		}
+	}
+
+	w.notFull.Wait()
+
+	return false
+}
+
+func (w *asyncWriter) drop(item asyncItem) {
+	item.buf.Free()
+
+	w.dropped++
+	w.droppedPending++
+}
+
+func (w *asyncWriter) droppedCount() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.dropped
+}
+
+func (w *asyncWriter) close() error {
+	w.mu.Lock()
+
+	if w.closed {
+		w.mu.Unlock()
+		return ErrCoreClosed
+	}
+
+	w.closed = true
+	w.notFull.Broadcast()
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	<-w.done
+
+	return w.err
+}
+
+// take removes all the items from the queue.
+func (w *asyncWriter) take(items []asyncItem) ([]asyncItem, uint64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	items = append(items[:0], w.items...)
+
+	for i := range w.items {
+		w.items[i] = asyncItem{}
+	}
+
+	w.items = w.items[:0]
+	w.entries = 0
+
+	dropped := w.droppedPending
+	w.droppedPending = 0
+
+	w.notFull.Broadcast()
+
+	return items, dropped, w.closed
+}
+
+// run writes queued entries until the writer is closed.
+func (w *asyncWriter) run() {
+	defer close(w.done)
+
+	var (
+		pendingBytes, pendingEntries int
+
+		timer  *time.Timer
+		timerC <-chan time.Time
+
+		items []asyncItem
+	)
+
+	flush := func() {
+		if err := w.out.Sync(); err != nil && w.err == nil {
+			w.err = err
+		}
+
+		pendingBytes, pendingEntries = 0, 0
+
+		if timer != nil {
+			timer.Stop()
+			timer, timerC = nil, nil
+		}
+	}
+
+	write := func(buf *buffer.Buffer) {
+		if _, err := w.out.Write(buf.Bytes()); err != nil && w.err == nil {
+			w.err = err
+		}
+
+		pendingBytes += buf.Len()
+		pendingEntries++
+
+		buf.Free()
+
+		if pendingBytes >= w.cfg.FlushBytes || pendingEntries >= w.cfg.FlushEntries {
+			flush()
+		} else if timer == nil {
+			timer = time.NewTimer(w.cfg.FlushInterval)
+			timerC = timer.C
+		}
+	}
+
+	for {
+		select {
+		case <-w.wake:
+		case <-timerC:
+			timer, timerC = nil, nil
+
+			flush()
+
+			continue
+		}
+
+		var (
+			dropped uint64
+			closed  bool
+		)
+
+		items, dropped, closed = w.take(items)
+
+		if dropped > 0 {
+			// queue has room again, report dropped entries
+			if buf, err := w.droppedEntry(dropped); err == nil {
+				write(buf)
+			}
+		}
+
+		for _, item := range items {
+			if item.done != nil {
+				flush()
+
+				item.done <- w.err
+				w.err = nil
+
+				continue
+			}
+
+			write(item.buf)
+		}
+
+		if closed {
+			flush()
+
+			return
+		}
+	}
+}
+
+// droppedEntry encodes the entry reporting the number of dropped entries.
+func (w *asyncWriter) droppedEntry(dropped uint64) (*buffer.Buffer, error) {
+	return w.enc.EncodeEntry(zapcore.Entry{
+		Level:   zapcore.WarnLevel,
+		Time:    time.Now(),
+		Message: strconv.FormatUint(dropped, 10) + " logs dropped",
+	}, []zapcore.Field{
+		{Key: "dropped", Type: zapcore.Uint64Type, Integer: int64(dropped)},
+	})
+}
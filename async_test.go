@@ -0,0 +1,358 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+)
+
+// recordingSyncer records writes and syncs.
+type recordingSyncer struct {
+	mu      sync.Mutex
+	writes  int
+	pending int
+	synced  int
+	delay   time.Duration
+	err     error
+}
+
+func (s *recordingSyncer) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes++
+	s.pending++
+
+	return len(p), s.err
+}
+
+func (s *recordingSyncer) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending > 0 {
+		s.synced += s.pending
+		s.pending = 0
+	}
+
+	return nil
+}
+
+// state returns the number of written and synced entries.
+func (s *recordingSyncer) state() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writes, s.synced
+}
+
+func (s *recordingSyncer) waitSynced(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		_, synced := s.state()
+		if synced >= n || time.Now().After(deadline) {
+			require.Equal(t, n, synced)
+
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newAsyncLogger(out zapcore.WriteSyncer, cfg zapmsgpack.AsyncConfig) (*zap.Logger, *zapmsgpack.AsyncCore) {
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{MessageKey: "M"}, zapmsgpack.WithEpochTime())
+	core := zapmsgpack.NewAsyncCore(enc, out, zap.InfoLevel, cfg)
+
+	return zap.New(core), core
+}
+
+func TestAsyncCoreThresholds(t *testing.T) {
+	entrySize := len(encodeEntries(t, 1)[0])
+
+	for _, tt := range []struct {
+		desc string
+		cfg  zapmsgpack.AsyncConfig
+	}{
+		{
+			desc: "entries",
+			cfg: zapmsgpack.AsyncConfig{
+				FlushEntries:  3,
+				FlushInterval: time.Hour,
+			},
+		},
+		{
+			desc: "bytes",
+			cfg: zapmsgpack.AsyncConfig{
+				FlushBytes:    3*entrySize - 1,
+				FlushInterval: time.Hour,
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			out := &recordingSyncer{}
+			logger, core := newAsyncLogger(out, tt.cfg)
+
+			for i := 0; i < 5; i++ {
+				logger.Info("lob law", zap.Int("i", i))
+			}
+
+			out.waitSynced(t, 3)
+
+			require.NoError(t, logger.Sync())
+
+			writes, synced := out.state()
+			assert.Equal(t, 5, writes)
+			assert.Equal(t, 5, synced)
+
+			require.NoError(t, core.Close())
+		})
+	}
+}
+
+func TestAsyncCoreInterval(t *testing.T) {
+	out := &recordingSyncer{}
+	logger, core := newAsyncLogger(out, zapmsgpack.AsyncConfig{
+		FlushInterval: 10 * time.Millisecond,
+	})
+
+	defer core.Close()
+
+	logger.Info("lob law")
+	logger.Debug("not enabled")
+
+	out.waitSynced(t, 1)
+
+	logger.Info("lob law")
+
+	out.waitSynced(t, 2)
+}
+
+func TestAsyncCoreSync(t *testing.T) {
+	out := &recordingSyncer{delay: time.Millisecond}
+	logger, core := newAsyncLogger(out, zapmsgpack.AsyncConfig{
+		QueueSize:     2,
+		FlushInterval: time.Hour,
+	})
+
+	logger = logger.With(zap.String("k", "v"))
+
+	for i := 0; i < 10; i++ {
+		logger.Info("lob law")
+	}
+
+	// Sync blocks until the queue is drained
+	require.NoError(t, logger.Sync())
+
+	writes, synced := out.state()
+	assert.Equal(t, 10, writes)
+	assert.Equal(t, 10, synced)
+
+	// write errors are returned from Sync
+	out.mu.Lock()
+	out.err = errors.New("write failed")
+	out.mu.Unlock()
+
+	logger.Info("lob law")
+
+	assert.EqualError(t, logger.Sync(), "write failed")
+	assert.NoError(t, logger.Sync())
+
+	out.mu.Lock()
+	out.err = nil
+	out.mu.Unlock()
+
+	// entries are flushed on close
+	logger.Info("lob law")
+
+	require.NoError(t, core.Close())
+
+	writes, synced = out.state()
+	assert.Equal(t, 12, writes)
+	assert.Equal(t, 12, synced)
+
+	assert.Equal(t, zapmsgpack.ErrCoreClosed, core.Write(zapcore.Entry{}, nil))
+	assert.Equal(t, zapmsgpack.ErrCoreClosed, core.Sync())
+	assert.Equal(t, zapmsgpack.ErrCoreClosed, core.Close())
+}
+
+func TestAsyncCoreClient(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address: server.Addr(),
+		Tag:     "app.test",
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	logger, core := newAsyncLogger(client, zapmsgpack.AsyncConfig{FlushEntries: 3})
+
+	for i := 0; i < 6; i++ {
+		logger.Info("lob law", zap.Int("i", i))
+	}
+
+	require.NoError(t, core.Close())
+
+	messages := server.waitMessages(t, 2)
+	for _, msg := range messages {
+		assert.Len(t, msg.([]interface{})[1], 3)
+	}
+}
+
+// gatedSyncer records entry messages, writes block until the gate is opened.
+type gatedSyncer struct {
+	started chan struct{}
+	gate    chan struct{}
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func newGatedSyncer() *gatedSyncer {
+	return &gatedSyncer{
+		started: make(chan struct{}, 1),
+		gate:    make(chan struct{}),
+	}
+}
+
+func (s *gatedSyncer) Write(p []byte) (int, error) {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+
+	<-s.gate
+
+	var entry []interface{}
+	if err := msgpack.Unmarshal(p, &entry); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	s.messages = append(s.messages, entry[1].(map[string]interface{})["M"].(string))
+	s.mu.Unlock()
+
+	return len(p), nil
+}
+
+func (s *gatedSyncer) Sync() error {
+	return nil
+}
+
+func TestAsyncCoreOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		desc     string
+		cfg      zapmsgpack.AsyncConfig
+		expected []string
+		dropped  uint64
+	}{
+		{
+			desc:     "block",
+			cfg:      zapmsgpack.AsyncConfig{Overflow: zapmsgpack.OverflowBlock},
+			expected: []string{"1", "2", "3", "4", "5"},
+		},
+		{
+			desc:     "drop newest",
+			cfg:      zapmsgpack.AsyncConfig{Overflow: zapmsgpack.OverflowDropNewest},
+			expected: []string{"1", "2 logs dropped", "2", "3"},
+			dropped:  2,
+		},
+		{
+			desc:     "drop oldest",
+			cfg:      zapmsgpack.AsyncConfig{Overflow: zapmsgpack.OverflowDropOldest},
+			expected: []string{"1", "2 logs dropped", "4", "5"},
+			dropped:  2,
+		},
+		{
+			desc:     "drop below",
+			cfg:      zapmsgpack.AsyncConfig{Overflow: zapmsgpack.OverflowDropBelow, DropLevel: zapcore.WarnLevel},
+			expected: []string{"1", "1 logs dropped", "2", "3", "5"},
+			dropped:  1,
+		},
+		{
+			desc:     "drop below keeps errors",
+			cfg:      zapmsgpack.AsyncConfig{Overflow: zapmsgpack.OverflowDropBelow, DropLevel: zapcore.FatalLevel},
+			expected: []string{"1", "1 logs dropped", "2", "3", "5"},
+			dropped:  1,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			out := newGatedSyncer()
+
+			cfg := tt.cfg
+			cfg.QueueSize = 2
+			cfg.FlushInterval = time.Hour
+
+			logger, core := newAsyncLogger(out, cfg)
+
+			// first entry is taken from the queue, writer is blocked
+			logger.Info("1")
+			<-out.started
+
+			logger.Info("2")
+			logger.Info("3")
+
+			// queue is full
+			blocked := make(chan struct{})
+
+			go func() {
+				logger.Info("4")
+				logger.Error("5")
+				close(blocked)
+			}()
+
+			if tt.cfg.Overflow == zapmsgpack.OverflowDropNewest || tt.cfg.Overflow == zapmsgpack.OverflowDropOldest {
+				<-blocked
+			} else {
+				select {
+				case <-blocked:
+					t.Fatal("write should block")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			close(out.gate)
+			<-blocked
+
+			require.NoError(t, core.Close())
+
+			assert.Equal(t, tt.expected, out.messages)
+			assert.Equal(t, tt.dropped, core.Dropped())
+		})
+	}
+}
@@ -0,0 +1,1027 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Errors returned by Client.
+var (
+	// ErrClientClosed is returned when writing to the closed client.
+	ErrClientClosed = errors.New("zapmsgpack: client is closed")
+	// ErrBufferFull is returned when entry doesn't fit into the buffer of pending entries.
+	ErrBufferFull = errors.New("zapmsgpack: client buffer is full")
+	// ErrNoTag is returned when entry is written without a tag, and ClientConfig.Tag is not set.
+	ErrNoTag = errors.New("zapmsgpack: no tag for the entry")
+	// ErrAckMismatch is returned when fluentd acknowledges unexpected chunk.
+	ErrAckMismatch = errors.New("zapmsgpack: ack doesn't match chunk id")
+)
+
+// Client defaults.
+const (
+	DefaultFlushSize     = 64 * 1024
+	DefaultMaxBufferSize = 8 * 1024 * 1024
+	DefaultPoolSize      = 1
+	DefaultDialTimeout   = 5 * time.Second
+	DefaultWriteTimeout  = 10 * time.Second
+	DefaultMinBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff    = 30 * time.Second
+	DefaultAckTimeout    = 10 * time.Second
+	DefaultSpoolMaxBytes = 1024 * 1024 * 1024
+
+	DefaultHeartbeatInterval = time.Second
+)
+
+// ClientConfig configures fluentd forward protocol client.
+//
+// Zero values are replaced with defaults.
+type ClientConfig struct {
+	// Network is "tcp" (default), "tcp4", "tcp6" or "unix".
+	Network string
+	// Address of fluentd (or fluent-bit) forward input: host:port for TCP,
+	// socket path for unix domain socket.
+	//
+	// Address is a shortcut for a single endpoint, it can't be used
+	// along with Endpoints.
+	Address string
+	// Endpoints are fluentd forward inputs, messages are distributed between
+	// healthy primary endpoints according to the Balance mode. Standby
+	// endpoints are used only when all the primary endpoints are unhealthy.
+	//
+	// Endpoint is unhealthy if connection to it can't be established, or if
+	// message delivery fails (write error, ack timeout), it's retried after
+	// the backoff. Messages which failed to be delivered to
+	// one endpoint are sent to another one.
+	Endpoints []Endpoint
+	// Balance is the policy of distributing messages between endpoints.
+	Balance BalanceMode
+	// Tag of the entries encoded without tag. Entries encoded in message
+	// mode (WithMessageMode) carry their own tag.
+	Tag string
+	// Mode of forward protocol messages sent to fluentd.
+	Mode BatchMode
+
+	// FlushSize is the size of batched entries which triggers the flush.
+	FlushSize int
+	// MaxBufferSize limits the size of entries pending delivery, including
+	// entries which failed to be delivered. New entries are rejected
+	// with ErrBufferFull when the buffer is full.
+	MaxBufferSize int
+
+	// PoolSize is the maximum number of connections to each endpoint,
+	// connections are used by concurrent flushes.
+	PoolSize int
+	// DialTimeout limits the time to establish the connection.
+	DialTimeout time.Duration
+	// WriteTimeout limits the time to write single message.
+	WriteTimeout time.Duration
+	// MinBackoff and MaxBackoff are the bounds of exponential backoff
+	// between failed connection or delivery attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// RequireAck enables at-least-once delivery: every message carries unique
+	// chunk id, and fluentd acknowledges it once the message is accepted.
+	// Messages which were not acknowledged within AckTimeout are retransmitted
+	// with the same chunk id.
+	RequireAck bool
+	// AckTimeout limits the time to wait for the ack.
+	AckTimeout time.Duration
+
+	// SharedKey enables forward protocol handshake, client and fluentd prove
+	// each other they know the shared key. Handshake should complete within
+	// DialTimeout.
+	SharedKey string
+	// Username and Password authenticate the client, if fluentd requires
+	// user authentication.
+	Username string
+	Password string
+	// SelfHostname is the client hostname sent in the handshake, os.Hostname()
+	// by default.
+	SelfHostname string
+
+	// TLSConfig enables TLS transport (fluentd "transport tls").
+	//
+	// Server name is verified against TLSConfig.ServerName, or against the
+	// host from the endpoint address if ServerName is empty. Client certificates
+	// are set with TLSConfig.Certificates.
+	TLSConfig *tls.Config
+
+	// SpoolDir enables write-ahead disk spool: messages are stored in the
+	// directory before they are sent, and removed once delivered (or acknowledged,
+	// if the ack is required). Messages which failed to be delivered are kept
+	// only on disk, and replayed in order on the next flushes. Messages left
+	// undelivered are replayed by the next Client with the same SpoolDir,
+	// e.g. after the restart.
+	//
+	// Entries are spooled when the batch is flushed, batched entries are
+	// not stored on disk.
+	SpoolDir string
+	// SpoolMaxBytes limits disk usage of the spool, oldest messages are
+	// discarded when the limit is exceeded.
+	SpoolMaxBytes int64
+
+	// Heartbeat enables periodic health checks of the endpoints, so that
+	// dead endpoint is detected before messages are sent to it. Endpoint is
+	// unhealthy if there was no successful heartbeat within HeartbeatTimeout.
+	// Heartbeat retries unreachable endpoint right away, but it doesn't clear
+	// the backoff after failed handshake or delivery.
+	Heartbeat HeartbeatType
+	// HeartbeatInterval is the interval between heartbeats.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is three heartbeat intervals by default.
+	HeartbeatTimeout time.Duration
+}
+
+func (cfg *ClientConfig) setDefaults() {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+
+	if cfg.FlushSize <= 0 {
+		cfg.FlushSize = DefaultFlushSize
+	}
+
+	if cfg.MaxBufferSize <= 0 {
+		cfg.MaxBufferSize = DefaultMaxBufferSize
+	}
+
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = DefaultPoolSize
+	}
+
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = DefaultDialTimeout
+	}
+
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = DefaultWriteTimeout
+	}
+
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = DefaultAckTimeout
+	}
+
+	if cfg.SpoolMaxBytes <= 0 {
+		cfg.SpoolMaxBytes = DefaultSpoolMaxBytes
+	}
+
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	if cfg.HeartbeatTimeout <= 0 {
+		cfg.HeartbeatTimeout = 3 * cfg.HeartbeatInterval
+	}
+
+	if cfg.SelfHostname == "" {
+		cfg.SelfHostname, _ = os.Hostname()
+	}
+
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+}
+
+// message is serialized batch pending delivery.
+type message struct {
+	data []byte
+	// chunk id, empty if ack is not required
+	chunk string
+	// sequence number of the spool segment, zero if message is not spooled;
+	// data is nil if it's kept only on disk, segment is not written yet
+	// if data is not nil
+	seq uint64
+}
+
+// Client delivers entries produced by msgpack encoder to fluentd using forward protocol.
+//
+// Client implements zapcore.WriteSyncer, so it could be used as the destination
+// of zapcore.NewCore. Every write should be a single entry returned by EncodeEntry.
+//
+// Entries are batched per tag, batches are sent as forward protocol messages
+// when the size of batched entries reaches FlushSize, or when Sync is called.
+// Messages which failed to be delivered are retried on the next flush.
+//
+// With RequireAck, messages are considered delivered only when fluentd
+// acknowledges them, so fluentd restart doesn't lose the messages in flight.
+// Messages might be delivered more than once.
+//
+// With SpoolDir, messages are written to the disk before they are sent, so
+// they are not lost if fluentd is unreachable for a long time, or if the process
+// is restarted. Messages which failed to be delivered are kept only on disk.
+//
+// See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+type Client struct {
+	cfg      ClientConfig
+	balancer *balancer
+	spool    *spool
+
+	mu sync.Mutex
+	// batches of entries per tag, tags are kept in order of appearance
+	batches map[string]*Batch
+	tags    []string
+	batched int
+	// serialized messages pending delivery, queued is the size
+	// of messages kept in memory
+	queue  []message
+	queued int
+	// number of flushes in progress, flushed is signaled when flush is done
+	inflight int
+	flushed  *sync.Cond
+	// closing is set by Close, closed is set once pending messages are discarded
+	closing bool
+	closed  bool
+
+	// heartbeat goroutines are stopped on close
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewClient creates fluentd forward protocol client.
+//
+// Connection is established on the first flush. Messages left in the spool are
+// sent on the first flush as well.
+func NewClient(cfg ClientConfig) (*Client, error) {
+	switch {
+	case cfg.Address == "" && len(cfg.Endpoints) == 0:
+		return nil, errors.New("zapmsgpack: client address is not set")
+	case cfg.Address != "" && len(cfg.Endpoints) > 0:
+		return nil, errors.New("zapmsgpack: client address can't be used along with endpoints")
+	}
+
+	cfg.setDefaults()
+
+	endpoints := cfg.Endpoints
+	if cfg.Address != "" {
+		endpoints = []Endpoint{{Address: cfg.Address}}
+	}
+
+	b := &balancer{mode: cfg.Balance}
+
+	for _, e := range endpoints {
+		if e.Network == "" {
+			e.Network = cfg.Network
+		}
+
+		switch e.Network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return nil, errors.New("zapmsgpack: unsupported client network " + e.Network)
+		}
+
+		if e.Weight <= 0 {
+			e.Weight = 1
+		}
+
+		b.endpoints = append(b.endpoints, &endpoint{
+			Endpoint: e,
+			pool:     newConnPool(&cfg, e),
+			heartbeat: heartbeat{
+				enabled:  cfg.Heartbeat != HeartbeatNone,
+				timeout:  cfg.HeartbeatTimeout,
+				lastSeen: time.Now(),
+			},
+		})
+	}
+
+	c := &Client{
+		cfg:      cfg,
+		balancer: b,
+		batches:  make(map[string]*Batch),
+		stop:     make(chan struct{}),
+	}
+	c.flushed = sync.NewCond(&c.mu)
+
+	if cfg.SpoolDir != "" {
+		var err error
+
+		// messages left from the previous run are sent first
+		if c.spool, c.queue, err = openSpool(cfg.SpoolDir, cfg.SpoolMaxBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Heartbeat != HeartbeatNone {
+		for _, ep := range b.endpoints {
+			c.wg.Add(1)
+
+			go c.runHeartbeat(ep)
+		}
+	}
+
+	return c, nil
+}
+
+// Write appends an entry (or a message encoded with WithMessageMode) to the batch.
+//
+// If the write triggers the flush, delivery error is returned along with
+// len(p): entry is accepted and delivery is retried on the next flush.
+func (c *Client) Write(p []byte) (int, error) {
+	tag := c.cfg.Tag
+
+	if len(p) > 0 && p[0] == fixArrayCode|3 {
+		var err error
+
+		if tag, err = MessageTag(p); err != nil {
+			return 0, err
+		}
+	} else if tag == "" {
+		return 0, ErrNoTag
+	}
+
+	c.mu.Lock()
+
+	if c.closing {
+		c.mu.Unlock()
+		return 0, ErrClientClosed
+	}
+
+	if c.batched+c.queued+len(p) > c.cfg.MaxBufferSize {
+		c.mu.Unlock()
+		return 0, ErrBufferFull
+	}
+
+	batch := c.batches[tag]
+	if batch == nil {
+		batch = NewBatch(tag)
+		batch.Mode = c.cfg.Mode
+
+		c.batches[tag] = batch
+		c.tags = append(c.tags, tag)
+	}
+
+	size := batch.Size()
+
+	if err := batch.Append(p); err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+
+	c.batched += batch.Size() - size
+
+	flush := c.batched >= c.cfg.FlushSize
+	if flush {
+		c.seal()
+	}
+
+	c.mu.Unlock()
+
+	if flush {
+		if err := c.flush(); err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Sync sends all the batched entries to fluentd.
+//
+// Sync waits for flushes in progress, and retries delivery of the messages
+// which failed to be delivered before.
+func (c *Client) Sync() error {
+	c.mu.Lock()
+	c.seal()
+
+	for c.inflight > 0 {
+		c.flushed.Wait()
+	}
+
+	c.mu.Unlock()
+
+	return c.flush()
+}
+
+// Close flushes batched entries and closes connections to fluentd.
+//
+// Entries which failed to be delivered are discarded, unless they are kept
+// in the spool.
+func (c *Client) Close() error {
+	c.mu.Lock()
+
+	if c.closing {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+
+	// new entries are rejected while batched entries are flushed
+	c.closing = true
+	c.mu.Unlock()
+
+	err := c.Sync()
+
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	c.queued = 0
+
+	for c.inflight > 0 {
+		c.flushed.Wait()
+	}
+
+	c.mu.Unlock()
+
+	close(c.stop)
+	c.wg.Wait()
+
+	for _, ep := range c.balancer.endpoints {
+		ep.pool.close()
+	}
+
+	return err
+}
+
+// seal serializes batches into messages pending delivery.
+//
+// Should be called with c.mu held.
+func (c *Client) seal() {
+	for _, tag := range c.tags {
+		batch := c.batches[tag]
+		if batch.Len() == 0 {
+			continue
+		}
+
+		if c.cfg.RequireAck {
+			batch.Options.Chunk = newChunkID()
+		}
+
+		msg := message{
+			data:  batch.AppendTo(nil),
+			chunk: batch.Options.Chunk,
+		}
+
+		if c.spool != nil {
+			// segments are replayed in order of sealing, even if they are
+			// written by concurrent flushes
+			msg.seq = c.spool.reserve()
+		}
+
+		c.queue = append(c.queue, msg)
+		c.queued += len(msg.data)
+
+		batch.Reset()
+	}
+
+	c.batched = 0
+}
+
+// flush delivers pending messages, messages which were not delivered are put
+// back to the head of the queue.
+func (c *Client) flush() error {
+	c.mu.Lock()
+
+	queue := c.queue
+	c.queue = nil
+
+	if len(queue) == 0 || c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.inflight++
+	c.mu.Unlock()
+
+	queuedSize := 0
+	for _, msg := range queue {
+		queuedSize += len(msg.data)
+	}
+
+	var evicted []uint64
+
+	if c.spool != nil {
+		evicted = c.spoolMessages(queue)
+	}
+
+	sent, err := c.send(queue)
+
+	unsent := queue[sent:len(queue):len(queue)]
+
+	// undelivered messages are kept only on disk
+	for i := range unsent {
+		if unsent[i].seq != 0 {
+			unsent[i].data = nil
+		}
+	}
+
+	c.mu.Lock()
+
+	// pending messages are discarded when client is closed
+	if !c.closed {
+		c.queued -= queuedSize
+
+		for _, msg := range unsent {
+			c.queued += len(msg.data)
+		}
+
+		c.queue = append(unsent, c.queue...)
+
+		if len(evicted) > 0 {
+			c.queue = removeEvicted(c.queue, evicted)
+		}
+	}
+
+	c.inflight--
+	c.flushed.Broadcast()
+	c.mu.Unlock()
+
+	return err
+}
+
+// spoolMessages writes messages to the spool before they are sent.
+//
+// Messages which failed to be spooled are kept only in memory. Sequence numbers
+// of the segments evicted from the spool are returned.
+func (c *Client) spoolMessages(queue []message) []uint64 {
+	var evicted []uint64
+
+	for i := range queue {
+		if queue[i].seq == 0 || queue[i].data == nil {
+			continue
+		}
+
+		seqs, err := c.spool.push(&queue[i])
+		if err != nil {
+			queue[i].seq = 0
+			continue
+		}
+
+		evicted = append(evicted, seqs...)
+	}
+
+	return evicted
+}
+
+// removeEvicted removes messages evicted from the spool.
+func removeEvicted(queue []message, evicted []uint64) []message {
+	isEvicted := make(map[uint64]bool, len(evicted))
+	for _, seq := range evicted {
+		isEvicted[seq] = true
+	}
+
+	n := 0
+
+	for _, msg := range queue {
+		if msg.seq != 0 && isEvicted[msg.seq] {
+			continue
+		}
+
+		queue[n] = msg
+		n++
+	}
+
+	return queue[:n]
+}
+
+// send writes messages to the endpoints, it returns the number of messages
+// delivered.
+//
+// Messages which failed to be delivered to one endpoint are sent to another one.
+// Messages which can't be read from the spool are counted as processed, spool
+// error is returned if the rest of messages are delivered.
+func (c *Client) send(queue []message) (int, error) {
+	var (
+		sent     int
+		err      error
+		spoolErr error
+		excluded []*endpoint
+	)
+
+	for sent < len(queue) {
+		ep := c.balancer.pick(excluded, len(queue)-sent)
+		if ep == nil {
+			if err == nil {
+				err = ErrNoEndpoints
+			}
+
+			return sent, err
+		}
+
+		var (
+			n       int
+			readErr error
+		)
+
+		n, readErr, err = c.sendTo(ep, queue[sent:])
+		c.balancer.done(ep, len(queue)-sent)
+
+		sent += n
+
+		if readErr != nil {
+			spoolErr = readErr
+		}
+
+		if err != nil {
+			excluded = append(excluded, ep)
+		}
+	}
+
+	return sent, spoolErr
+}
+
+// sendTo writes messages to the connection to the endpoint, it returns the number
+// of messages delivered.
+//
+// If the ack is required, it's awaited before sending next message. Messages
+// kept in the spool are removed from it once delivered.
+//
+// Segments which can't be read from the spool are quarantined and skipped,
+// as it's not the endpoint failure. The last spool error is returned
+// separately from delivery error.
+func (c *Client) sendTo(ep *endpoint, queue []message) (sent int, spoolErr, err error) {
+	conn, err := ep.pool.get()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for i, msg := range queue {
+		data := msg.data
+
+		if data == nil {
+			if data, err = c.spool.read(msg.seq); err != nil {
+				if os.IsNotExist(err) {
+					// message was evicted from the spool
+					continue
+				}
+
+				if err == errCorruptedSegment {
+					c.spool.remove(msg.seq)
+					continue
+				}
+
+				c.spool.quarantine(msg.seq)
+				spoolErr = err
+
+				continue
+			}
+		}
+
+		if err = conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout)); err == nil {
+			_, err = conn.Write(data)
+		}
+
+		if err == nil && msg.chunk != "" {
+			err = conn.readAck(msg.chunk, c.cfg.AckTimeout)
+		}
+
+		if err != nil {
+			ep.pool.put(conn, err)
+
+			return i, spoolErr, err
+		}
+
+		if msg.seq != 0 {
+			c.spool.remove(msg.seq)
+		}
+	}
+
+	ep.pool.put(conn, nil)
+
+	return len(queue), spoolErr, nil
+}
+
+// connPool keeps connections to fluentd.
+//
+// Number of connections is limited by the number of slots, idle connections
+// are reused.
+type connPool struct {
+	network     string
+	address     string
+	dialTimeout time.Duration
+	tlsConfig   *tls.Config
+
+	slots chan struct{}
+	idle  chan *conn
+
+	handshake handshake
+
+	// mu protects backoff, connections are established concurrently
+	mu      sync.Mutex
+	backoff backoff
+}
+
+func newConnPool(cfg *ClientConfig, e Endpoint) *connPool {
+	return &connPool{
+		network:     e.Network,
+		address:     e.Address,
+		dialTimeout: cfg.DialTimeout,
+		tlsConfig:   cfg.TLSConfig,
+		slots:       make(chan struct{}, cfg.PoolSize),
+		idle:        make(chan *conn, cfg.PoolSize),
+		handshake: handshake{
+			sharedKey: cfg.SharedKey,
+			username:  cfg.Username,
+			password:  cfg.Password,
+			hostname:  cfg.SelfHostname,
+		},
+		backoff: backoff{
+			min: cfg.MinBackoff,
+			max: cfg.MaxBackoff,
+		},
+	}
+}
+
+// get returns idle connection or establishes new one.
+func (p *connPool) get() (*conn, error) {
+	p.slots <- struct{}{}
+
+	select {
+	case conn := <-p.idle:
+		if isAlive(conn) {
+			return conn, nil
+		}
+
+		_ = conn.Close()
+	default:
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		<-p.slots
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// put returns connection to the pool, connection is closed if it failed.
+//
+// Failed delivery puts the endpoint into backoff, as endpoint might accept
+// connections but never acknowledge messages. Backoff is reset once messages
+// are delivered.
+func (p *connPool) put(conn *conn, err error) {
+	p.mu.Lock()
+	if err != nil {
+		p.backoff.fail(err)
+	} else {
+		p.backoff.reset()
+	}
+	p.mu.Unlock()
+
+	if err != nil || !conn.keepalive {
+		_ = conn.Close()
+	} else {
+		p.idle <- conn
+	}
+
+	<-p.slots
+}
+
+// conn is connection to fluentd.
+type conn struct {
+	net.Conn
+
+	// decoder of fluentd responses, it's created on first use
+	dec *msgpack.Decoder
+	// connection could be reused for the next messages, fluentd might
+	// disable keepalive in the handshake
+	keepalive bool
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{
+		Conn:      c,
+		keepalive: true,
+	}
+}
+
+func (conn *conn) decoder() *msgpack.Decoder {
+	if conn.dec == nil {
+		conn.dec = msgpack.NewDecoder(conn.Conn)
+	}
+
+	return conn.dec
+}
+
+// ackResponse is fluentd response to the message with chunk option.
+type ackResponse struct {
+	Ack string `msgpack:"ack"`
+}
+
+// readAck waits for the ack of the chunk.
+func (conn *conn) readAck(chunk string, timeout time.Duration) error {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	var resp ackResponse
+
+	if err := conn.decoder().Decode(&resp); err != nil {
+		return err
+	}
+
+	if resp.Ack != chunk {
+		return ErrAckMismatch
+	}
+
+	return nil
+}
+
+// newChunkID generates unique chunk id: base64-encoded 128-bit random number.
+func newChunkID() string {
+	var id [16]byte
+
+	// crypto/rand never fails on supported platforms
+	_, _ = rand.Read(id[:])
+
+	return base64.StdEncoding.EncodeToString(id[:])
+}
+
+// healthy returns false if connection to the endpoint failed recently.
+func (p *connPool) healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return !time.Now().Before(p.backoff.next)
+}
+
+// lastError returns the reason connection failed, if it's in backoff.
+func (p *connPool) lastError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.backoff.err
+}
+
+// reachable resets the backoff if endpoint was unreachable, backoff after
+// failed handshake or delivery is kept.
+func (p *connPool) reachable() {
+	p.mu.Lock()
+	if p.backoff.unreachable {
+		p.backoff.reset()
+	}
+	p.mu.Unlock()
+}
+
+// isAlive checks whether idle connection was closed by the peer.
+//
+// Writes to closed connection might succeed, so data would be lost.
+func isAlive(conn *conn) bool {
+	// expired deadline fails the read without checking the socket, so short
+	// deadline is used instead
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+
+	var b [1]byte
+
+	_, err := conn.Read(b[:])
+
+	// peer is not supposed to send anything, so only timeout is expected
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return conn.SetReadDeadline(time.Time{}) == nil
+	}
+
+	return false
+}
+
+// dial establishes new connection, failed attempts are followed by backoff
+// period when connection is not attempted.
+func (p *connPool) dial() (*conn, error) {
+	p.mu.Lock()
+
+	if time.Now().Before(p.backoff.next) {
+		defer p.mu.Unlock()
+
+		return nil, p.backoff.err
+	}
+
+	p.mu.Unlock()
+
+	conn, err := p.connect()
+
+	if err != nil {
+		p.mu.Lock()
+		p.backoff.fail(err)
+		p.backoff.unreachable = isDialError(err)
+		p.mu.Unlock()
+
+		return nil, err
+	}
+
+	// backoff is reset only when messages are delivered, so that it grows
+	// if endpoint keeps failing after the connection is established
+	return conn, nil
+}
+
+// connect establishes new connection and performs the handshake.
+func (p *connPool) connect() (*conn, error) {
+	var (
+		c   net.Conn
+		err error
+	)
+
+	if p.tlsConfig != nil {
+		// dial timeout covers TLS handshake as well
+		c, err = tls.DialWithDialer(&net.Dialer{Timeout: p.dialTimeout}, p.network, p.address, p.tlsConfig)
+	} else {
+		c, err = net.DialTimeout(p.network, p.address, p.dialTimeout)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newConn(c)
+
+	if p.handshake.enabled() {
+		if err = p.handshake.run(conn, p.dialTimeout); err != nil {
+			_ = conn.Close()
+
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// close waits for connections in use and closes idle connections.
+func (p *connPool) close() {
+	for i := 0; i < cap(p.slots); i++ {
+		p.slots <- struct{}{}
+	}
+
+	for {
+		select {
+		case conn := <-p.idle:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// backoff tracks exponential backoff between failed attempts.
+type backoff struct {
+	min, max time.Duration
+
+	attempts uint
+	next     time.Time
+	err      error
+	// connection to the endpoint couldn't be established
+	unreachable bool
+}
+
+func (b *backoff) fail(err error) {
+	delay := b.max
+	if b.attempts < 32 && b.min<<b.attempts < b.max {
+		delay = b.min << b.attempts
+	}
+
+	b.attempts++
+	b.next = time.Now().Add(delay)
+	b.err = err
+	b.unreachable = false
+}
+
+func (b *backoff) reset() {
+	b.attempts = 0
+	b.next = time.Time{}
+	b.err = nil
+	b.unreachable = false
+}
+
+// isDialError returns true if connection failed before TLS or forward protocol
+// handshake.
+func isDialError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+
+	return ok && opErr.Op == "dial"
+}
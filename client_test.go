@@ -0,0 +1,756 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+)
+
+// fakeServer is in-process fluentd forward input, it records decoded messages.
+type fakeServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	messages []interface{}
+	conns    []net.Conn
+	wg       sync.WaitGroup
+	// number of chunks which are not acknowledged
+	skipAcks int
+	// handshake is performed if sharedKey is set, user is authenticated
+	// if username is set, server proves it knows serverKey
+	sharedKey, serverKey string
+	username, password   string
+}
+
+func newFakeServer(t *testing.T, address string) *fakeServer {
+	return newFakeNetworkServer(t, "tcp", address)
+}
+
+func newFakeNetworkServer(t *testing.T, network, address string) *fakeServer {
+	l, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	return serveFake(l)
+}
+
+func newFakeTLSServer(t *testing.T, cfg *tls.Config) *fakeServer {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+
+	return serveFake(l)
+}
+
+func serveFake(l net.Listener) *fakeServer {
+	s := &fakeServer{l: l}
+
+	s.wg.Add(1)
+
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeServer) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+
+	dec := msgpack.NewDecoder(conn)
+
+	if !s.handshake(conn, dec) {
+		_ = conn.Close()
+		return
+	}
+
+	for {
+		msg, err := dec.DecodeInterface()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.messages = append(s.messages, msg)
+
+		chunk := messageChunk(msg)
+		ack := chunk != "" && s.skipAcks == 0
+
+		if chunk != "" && s.skipAcks > 0 {
+			s.skipAcks--
+		}
+		s.mu.Unlock()
+
+		if ack {
+			resp, _ := msgpack.Marshal(map[string]string{"ack": chunk})
+			if _, err = conn.Write(resp); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handshake performs server side of forward protocol handshake.
+func (s *fakeServer) handshake(conn net.Conn, dec *msgpack.Decoder) bool {
+	s.mu.Lock()
+	sharedKey, serverKey, username, password := s.sharedKey, s.serverKey, s.username, s.password
+	s.mu.Unlock()
+
+	if sharedKey == "" {
+		return true
+	}
+
+	if serverKey == "" {
+		serverKey = sharedKey
+	}
+
+	nonce, authSalt := []byte("nonce"), ""
+	if username != "" {
+		authSalt = "salt"
+	}
+
+	helo, _ := msgpack.Marshal([]interface{}{"HELO", map[string]interface{}{
+		"nonce":     nonce,
+		"auth":      authSalt,
+		"keepalive": true,
+	}})
+	if _, err := conn.Write(helo); err != nil {
+		return false
+	}
+
+	var ping []string
+	if err := dec.Decode(&ping); err != nil || len(ping) != 6 || ping[0] != "PING" {
+		return false
+	}
+
+	hostname, salt := ping[1], ping[2]
+	result, reason := true, ""
+
+	switch {
+	case ping[3] != sha512Hex(salt, hostname, string(nonce), sharedKey):
+		result, reason = false, "shared key mismatch"
+	case username != "" && (ping[4] != username || ping[5] != sha512Hex(authSalt, username, password)):
+		result, reason = false, "username/password mismatch"
+	}
+
+	pong, _ := msgpack.Marshal([]interface{}{"PONG", result, reason, "fluentd",
+		sha512Hex(salt, "fluentd", string(nonce), serverKey)})
+	if _, err := conn.Write(pong); err != nil {
+		return false
+	}
+
+	return result
+}
+
+func sha512Hex(parts ...string) string {
+	return fmt.Sprintf("%x", sha512.Sum512([]byte(strings.Join(parts, ""))))
+}
+
+// messageChunk returns chunk option of the forward protocol message.
+func messageChunk(msg interface{}) string {
+	fields, ok := msg.([]interface{})
+	if !ok || len(fields) != 3 {
+		return ""
+	}
+
+	option, ok := fields[2].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	chunk, _ := option["chunk"].(string)
+
+	return chunk
+}
+
+// waitMessages waits for n messages to be received.
+func (s *fakeServer) waitMessages(t *testing.T, n int) []interface{} {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		s.mu.Lock()
+		messages := append([]interface{}(nil), s.messages...)
+		s.mu.Unlock()
+
+		if len(messages) >= n || time.Now().After(deadline) {
+			require.Len(t, messages, n)
+
+			return messages
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *fakeServer) Close() {
+	_ = s.l.Close()
+
+	s.mu.Lock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+func newClientLogger(t *testing.T, cfg zapmsgpack.ClientConfig, opts ...zapmsgpack.Option) (*zap.Logger, *zapmsgpack.Client) {
+	client, err := zapmsgpack.NewClient(cfg)
+	require.NoError(t, err)
+
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{MessageKey: "M"},
+		append([]zapmsgpack.Option{zapmsgpack.WithEpochTime()}, opts...)...)
+
+	return zap.New(zapcore.NewCore(enc, client, zap.DebugLevel)), client
+}
+
+func TestClient(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	logger, client := newClientLogger(t, zapmsgpack.ClientConfig{
+		Address: server.Addr(),
+		Tag:     "app.test",
+	})
+
+	for i := 0; i < 3; i++ {
+		logger.Info("lob law", zap.Int("i", i))
+	}
+
+	require.NoError(t, logger.Sync())
+
+	messages := server.waitMessages(t, 1)
+	msg := messages[0].([]interface{})
+	assert.Equal(t, "app.test", msg[0])
+	assert.Len(t, msg[1], 3)
+	assert.Equal(t, map[string]interface{}{"size": int8(3)}, msg[2])
+
+	// nothing to flush
+	require.NoError(t, logger.Sync())
+
+	logger.Info("lob law")
+	require.NoError(t, client.Close())
+
+	server.waitMessages(t, 2)
+
+	_, err := client.Write(encodeEntries(t, 1)[0])
+	assert.Equal(t, zapmsgpack.ErrClientClosed, err)
+	assert.Equal(t, zapmsgpack.ErrClientClosed, client.Close())
+}
+
+func TestClientFlushSize(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:   server.Addr(),
+		Tag:       "app.test",
+		FlushSize: 1,
+		Mode:      zapmsgpack.PackedForwardMode,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	for _, entry := range encodeEntries(t, 2) {
+		n, err := client.Write(entry)
+		require.NoError(t, err)
+		assert.Equal(t, len(entry), n)
+	}
+
+	messages := server.waitMessages(t, 2)
+	for i, msg := range messages {
+		assert.Equal(t, "app.test", msg.([]interface{})[0])
+		assert.Equal(t, expectedEntries(2)[i:i+1], decodeEntryStream(msg.([]interface{})[1].([]byte)))
+	}
+}
+
+func TestClientMessageMode(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	logger, client := newClientLogger(t, zapmsgpack.ClientConfig{
+		Address: server.Addr(),
+	}, zapmsgpack.WithMessageMode(zapmsgpack.PrefixTag("app.", zapmsgpack.LoggerNameTag(""))))
+
+	logger.Named("db").Info("lob law")
+	logger.Named("http").Info("lob law")
+	logger.Named("db").Info("lob law")
+	logger.Info("lob law")
+
+	require.NoError(t, client.Close())
+
+	tags := map[string]int{}
+	for _, msg := range server.waitMessages(t, 3) {
+		tags[msg.([]interface{})[0].(string)] = len(msg.([]interface{})[1].([]interface{}))
+	}
+
+	assert.Equal(t, map[string]int{"app.db": 2, "app.http": 1, "app": 1}, tags)
+
+	// entries without tag are rejected if client has no default tag
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{Address: server.Addr()})
+	require.NoError(t, err)
+
+	_, err = client.Write(encodeEntries(t, 1)[0])
+	assert.Equal(t, zapmsgpack.ErrNoTag, err)
+}
+
+func TestClientReconnect(t *testing.T) {
+	// reserve the address, fluentd is not listening yet
+	server := newFakeServer(t, "127.0.0.1:0")
+	address := server.Addr()
+	server.Close()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:       address,
+		Tag:           "app.test",
+		MinBackoff:    50 * time.Millisecond,
+		MaxBufferSize: 1024,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	entries := encodeEntries(t, 3)
+
+	_, err = client.Write(entries[0])
+	require.NoError(t, err)
+
+	assert.Error(t, client.Sync())
+
+	// entries are kept until delivered
+	_, err = client.Write(entries[1])
+	require.NoError(t, err)
+
+	// connection is not attempted during backoff
+	server = newFakeServer(t, address)
+	defer server.Close()
+
+	assert.Error(t, client.Sync())
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, client.Sync())
+
+	messages := server.waitMessages(t, 2)
+	assert.Equal(t, expectedEntries(2)[:1], messages[0].([]interface{})[1])
+	assert.Equal(t, expectedEntries(2)[1:], messages[1].([]interface{})[1])
+
+	// connection is reestablished after failure
+	server.Close()
+
+	server = newFakeServer(t, address)
+	defer server.Close()
+
+	_, err = client.Write(entries[2])
+	require.NoError(t, err)
+
+	require.NoError(t, client.Sync())
+
+	messages = server.waitMessages(t, 1)
+	assert.Equal(t, expectedEntries(3)[2:], messages[0].([]interface{})[1])
+}
+
+func TestClientBufferFull(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	address := server.Addr()
+	server.Close()
+
+	entry := encodeEntries(t, 1)[0]
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:       address,
+		Tag:           "app.test",
+		MaxBufferSize: 2 * len(entry),
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err = client.Write(entry)
+		require.NoError(t, err)
+	}
+
+	_, err = client.Write(entry)
+	assert.Equal(t, zapmsgpack.ErrBufferFull, err)
+
+	assert.Error(t, client.Sync())
+
+	_, err = client.Write(entry)
+	assert.Equal(t, zapmsgpack.ErrBufferFull, err)
+}
+
+func TestClientAck(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:    server.Addr(),
+		Tag:        "app.test",
+		RequireAck: true,
+		AckTimeout: 100 * time.Millisecond,
+		MinBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	entries := encodeEntries(t, 2)
+
+	_, err = client.Write(entries[0])
+	require.NoError(t, err)
+	require.NoError(t, client.Sync())
+
+	messages := server.waitMessages(t, 1)
+	chunk := messages[0].([]interface{})[2].(map[string]interface{})["chunk"].(string)
+	id, err := base64.StdEncoding.DecodeString(chunk)
+	require.NoError(t, err)
+	assert.Len(t, id, 16)
+
+	// fluentd doesn't acknowledge the chunk, so it's retransmitted
+	server.mu.Lock()
+	server.skipAcks = 1
+	server.mu.Unlock()
+
+	_, err = client.Write(entries[1])
+	require.NoError(t, err)
+
+	assert.Error(t, client.Sync())
+
+	// endpoint is retried after the backoff
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, client.Sync())
+
+	messages = server.waitMessages(t, 3)
+	assert.NotEqual(t, chunk, messageChunk(messages[1]))
+	assert.Equal(t, messages[1], messages[2])
+	assert.Equal(t, expectedEntries(2)[1:], messages[2].([]interface{})[1])
+}
+
+func TestClientHandshake(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	server.mu.Lock()
+	server.sharedKey = "secret"
+	server.username, server.password = "user", "pass"
+	server.mu.Unlock()
+
+	for _, tt := range []struct {
+		desc      string
+		sharedKey string
+		password  string
+		serverKey string
+		expected  error
+	}{
+		{
+			desc:      "ok",
+			sharedKey: "secret",
+			password:  "pass",
+		},
+		{
+			desc:      "shared key mismatch",
+			sharedKey: "wrong",
+			password:  "pass",
+			expected:  &zapmsgpack.AuthError{Reason: "shared key mismatch"},
+		},
+		{
+			desc:      "password mismatch",
+			sharedKey: "secret",
+			password:  "wrong",
+			expected:  &zapmsgpack.AuthError{Reason: "username/password mismatch"},
+		},
+		{
+			desc:      "server digest mismatch",
+			sharedKey: "secret",
+			password:  "pass",
+			serverKey: "wrong",
+			expected:  zapmsgpack.ErrServerDigest,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server.mu.Lock()
+			server.serverKey = tt.serverKey
+			server.messages = nil
+			server.mu.Unlock()
+
+			client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+				Address:      server.Addr(),
+				Tag:          "app.test",
+				SharedKey:    tt.sharedKey,
+				Username:     "user",
+				Password:     tt.password,
+				SelfHostname: "client",
+			})
+			require.NoError(t, err)
+
+			defer client.Close()
+
+			for _, entry := range encodeEntries(t, 2) {
+				_, err = client.Write(entry)
+				require.NoError(t, err)
+
+				assert.Equal(t, tt.expected, client.Sync())
+			}
+
+			if tt.expected == nil {
+				server.waitMessages(t, 2)
+			}
+		})
+	}
+}
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	ca := newTestCA(t)
+
+	server := newFakeTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "fluentd.local", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer server.Close()
+
+	clientCert := ca.issue(t, "client", x509.ExtKeyUsageClientAuth)
+
+	for _, tt := range []struct {
+		desc      string
+		tlsConfig *tls.Config
+		ok        bool
+	}{
+		{
+			desc: "ok",
+			tlsConfig: &tls.Config{
+				RootCAs:      ca.pool,
+				ServerName:   "fluentd.local",
+				Certificates: []tls.Certificate{clientCert},
+			},
+			ok: true,
+		},
+		{
+			desc: "server name mismatch",
+			tlsConfig: &tls.Config{
+				RootCAs:      ca.pool,
+				ServerName:   "fluentd.remote",
+				Certificates: []tls.Certificate{clientCert},
+			},
+		},
+		{
+			desc: "untrusted server",
+			tlsConfig: &tls.Config{
+				ServerName:   "fluentd.local",
+				Certificates: []tls.Certificate{clientCert},
+			},
+		},
+		{
+			desc: "no client certificate",
+			tlsConfig: &tls.Config{
+				RootCAs:    ca.pool,
+				ServerName: "fluentd.local",
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server.mu.Lock()
+			server.messages = nil
+			server.mu.Unlock()
+
+			// ack makes sure TLS handshake failure is detected on the client side
+			client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+				Address:    server.Addr(),
+				Tag:        "app.test",
+				TLSConfig:  tt.tlsConfig,
+				RequireAck: true,
+			})
+			require.NoError(t, err)
+
+			defer client.Close()
+
+			_, err = client.Write(encodeEntries(t, 1)[0])
+			require.NoError(t, err)
+
+			if !tt.ok {
+				assert.Error(t, client.Sync())
+				return
+			}
+
+			require.NoError(t, client.Sync())
+
+			messages := server.waitMessages(t, 1)
+			assert.Equal(t, expectedEntries(1), messages[0].([]interface{})[1])
+		})
+	}
+}
+
+func TestClientUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zapmsgpack")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fluent.sock")
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Network:    "unix",
+		Address:    path,
+		Tag:        "app.test",
+		MinBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	entries := encodeEntries(t, 2)
+
+	// sidecar is not started yet, entries are kept
+	_, err = client.Write(entries[0])
+	require.NoError(t, err)
+	assert.Error(t, client.Sync())
+
+	server := newFakeNetworkServer(t, "unix", path)
+
+	_, err = client.Write(entries[1])
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, client.Sync())
+
+	messages := server.waitMessages(t, 2)
+	assert.Equal(t, expectedEntries(2)[:1], messages[0].([]interface{})[1])
+	assert.Equal(t, expectedEntries(2)[1:], messages[1].([]interface{})[1])
+
+	// sidecar restarts
+	server.Close()
+
+	server = newFakeNetworkServer(t, "unix", path)
+	defer server.Close()
+
+	_, err = client.Write(entries[0])
+	require.NoError(t, err)
+	require.NoError(t, client.Sync())
+
+	server.waitMessages(t, 1)
+
+	_, err = zapmsgpack.NewClient(zapmsgpack.ClientConfig{Network: "udp", Address: path})
+	assert.Error(t, err)
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Encoder names used with zap.Config.Encoding.
+const (
+	// EncoderName is the name of the encoder with default options.
+	EncoderName = "msgpack"
+	// FluentdEncoderName is the name of the encoder which encodes entry timestamp
+	// as fluentd EventTime.
+	FluentdEncoderName = "fluentd"
+)
+
+// RegisterEncoder registers msgpack encoder with the options for use with
+// zap.Config under the name.
+//
+// Import "github.com/smira/zap-msgpack-encoder/register" to register encoders
+// as EncoderName and FluentdEncoderName.
+func RegisterEncoder(name string, opts ...Option) error {
+	return zap.RegisterEncoder(name, func(cfg zapcore.EncoderConfig) (zapcore.Encoder, error) {
+		return NewEncoder(cfg, opts...), nil
+	})
+}
+
+// EncoderOptions are encoder options which could be read from the config
+// along with zap.Config.
+type EncoderOptions struct {
+	// EntryTime is the encoding of entry timestamp: "event" (fluentd EventTime),
+	// "timestamp" (msgpack timestamp), "epoch", "epochfloat", "epochmillis",
+	// "epochnanos", "rfc3339" or "rfc3339nano".
+	//
+	// Msgpack timestamp extension is used by default.
+	EntryTime string `json:"entryTime" yaml:"entryTime"`
+	// FlatNamespaces enables WithFlatNamespaces.
+	FlatNamespaces bool `json:"flatNamespaces" yaml:"flatNamespaces"`
+	// CompactHeaders enables WithCompactHeaders.
+	CompactHeaders bool `json:"compactHeaders" yaml:"compactHeaders"`
+	// ComplexExt enables WithComplexExt with ComplexExtType.
+	ComplexExt     bool `json:"complexExt" yaml:"complexExt"`
+	ComplexExtType int8 `json:"complexExtType" yaml:"complexExtType"`
+
+	// Tag enables message mode with the static tag, it's the fallback tag
+	// if TagFromLoggerName or TagField is set.
+	Tag string `json:"tag" yaml:"tag"`
+	// TagFromLoggerName uses logger name as the tag.
+	TagFromLoggerName bool `json:"tagFromLoggerName" yaml:"tagFromLoggerName"`
+	// TagField uses the value of the field as the tag.
+	TagField string `json:"tagField" yaml:"tagField"`
+	// TagPrefix is prepended to the tag.
+	TagPrefix string `json:"tagPrefix" yaml:"tagPrefix"`
+}
+
+var entryTimeEncoders = map[string]zapcore.TimeEncoder{
+	"event":       EventTimeEncoder,
+	"timestamp":   TimestampTimeEncoder,
+	"epoch":       EpochSecondsTimeEncoder,
+	"epochfloat":  EpochFloatTimeEncoder,
+	"epochmillis": EpochMillisTimeEncoder,
+	"epochnanos":  EpochNanosTimeEncoder,
+	"rfc3339":     RFC3339TimeEncoder,
+	"rfc3339nano": RFC3339NanoTimeEncoder,
+}
+
+// Options converts EncoderOptions to encoder Options.
+func (o EncoderOptions) Options() ([]Option, error) {
+	var opts []Option
+
+	if o.EntryTime != "" {
+		timeEncoder, ok := entryTimeEncoders[o.EntryTime]
+		if !ok {
+			return nil, fmt.Errorf("zapmsgpack: unknown entry time encoding %q", o.EntryTime)
+		}
+
+		opts = append(opts, WithEntryTimeEncoder(timeEncoder))
+	}
+
+	if o.FlatNamespaces {
+		opts = append(opts, WithFlatNamespaces())
+	}
+
+	if o.CompactHeaders {
+		opts = append(opts, WithCompactHeaders())
+	}
+
+	if o.ComplexExt {
+		opts = append(opts, WithComplexExt(o.ComplexExtType))
+	}
+
+	var tag TagResolver
+
+	switch {
+	case o.TagField != "":
+		tag = FieldTag(o.TagField, o.Tag)
+	case o.TagFromLoggerName:
+		tag = LoggerNameTag(o.Tag)
+	case o.Tag != "":
+		tag = StaticTag(o.Tag)
+	case o.TagPrefix != "":
+		return nil, errors.New("zapmsgpack: tag prefix is set without the tag")
+	}
+
+	if tag != nil {
+		if o.TagPrefix != "" {
+			tag = PrefixTag(o.TagPrefix, tag)
+		}
+
+		opts = append(opts, WithMessageMode(tag))
+	}
+
+	return opts, nil
+}
+
+// Config is zap.Config extended with msgpack encoder options.
+//
+// Config could be unmarshaled from JSON or YAML, encoder options are read
+// from "msgpack" key:
+//
+//	level: info
+//	encoding: fluentd
+//	outputPaths: [stdout]
+//	encoderConfig:
+//	  messageKey: message
+//	msgpack:
+//	  tagPrefix: app.
+//	  tagFromLoggerName: true
+type Config struct {
+	zap.Config `json:",inline" yaml:",inline"`
+
+	Msgpack EncoderOptions `json:"msgpack" yaml:"msgpack"`
+}
+
+// Build constructs a logger from the Config.
+//
+// Encoder options are used if Encoding is EncoderName (or empty) or
+// FluentdEncoderName, other encodings are passed to zap as is.
+func (cfg Config) Build(opts ...zap.Option) (*zap.Logger, error) {
+	switch cfg.Encoding {
+	case "", EncoderName, FluentdEncoderName:
+		options := cfg.Msgpack
+		if cfg.Encoding == FluentdEncoderName && options.EntryTime == "" {
+			options.EntryTime = "event"
+		}
+
+		name, err := registerOptions(options)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Encoding = name
+	}
+
+	return cfg.Config.Build(opts...)
+}
+
+// registered encoders for EncoderOptions, zap registry is global, so every
+// set of options is registered once under generated name.
+var (
+	registeredMu      sync.Mutex
+	registeredOptions = map[EncoderOptions]string{}
+)
+
+func registerOptions(o EncoderOptions) (string, error) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+
+	if name, ok := registeredOptions[o]; ok {
+		return name, nil
+	}
+
+	opts, err := o.Options()
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-config-%d", EncoderName, len(registeredOptions)+1)
+
+	if err = RegisterEncoder(name, opts...); err != nil {
+		return "", err
+	}
+
+	registeredOptions[o] = name
+
+	return name, nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+	_ "github.com/smira/zap-msgpack-encoder/register"
+)
+
+func buildConfigLogger(t *testing.T, build func(outputPath string) (*zap.Logger, error)) []byte {
+	dir, err := ioutil.TempDir("", "zapmsgpack")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	outputPath := filepath.Join(dir, "out.log")
+
+	logger, err := build(outputPath)
+	require.NoError(t, err)
+
+	logger.Named("db").Info("lob law", zap.Int("i", 1))
+	require.NoError(t, logger.Sync())
+
+	out, err := ioutil.ReadFile(outputPath)
+	require.NoError(t, err)
+
+	return out
+}
+
+func TestRegisteredEncoder(t *testing.T) {
+	for _, encoding := range []string{zapmsgpack.EncoderName, zapmsgpack.FluentdEncoderName} {
+		t.Run(encoding, func(t *testing.T) {
+			out := buildConfigLogger(t, func(outputPath string) (*zap.Logger, error) {
+				cfg := zap.NewProductionConfig()
+				cfg.Encoding = encoding
+				cfg.OutputPaths = []string{outputPath}
+				cfg.EncoderConfig.TimeKey = ""
+				cfg.EncoderConfig.CallerKey = ""
+
+				return cfg.Build()
+			})
+
+			if encoding == zapmsgpack.FluentdEncoderName {
+				// [EventTime, record]
+				require.True(t, len(out) > 3)
+				assert.Equal(t, []byte{0x92, 0xd7, 0x00}, out[:3])
+
+				return
+			}
+
+			entries := decodeEntryStream(out)
+			require.Len(t, entries, 1)
+
+			entry := entries[0].([]interface{})
+			require.Len(t, entry, 2)
+
+			// entry timestamp is msgpack timestamp, not EncodeTime of production config
+			assert.IsType(t, &time.Time{}, entry[0])
+			assert.EqualValues(t, map[string]interface{}{
+				"level":  "info",
+				"logger": "db",
+				"msg":    "lob law",
+				"i":      int64(1),
+			}, entry[1])
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	out := buildConfigLogger(t, func(outputPath string) (*zap.Logger, error) {
+		var cfg zapmsgpack.Config
+
+		if err := json.Unmarshal([]byte(`{
+			"level": "info",
+			"encoding": "msgpack",
+			"outputPaths": [`+strconvQuote(outputPath)+`],
+			"encoderConfig": {
+				"messageKey": "M",
+				"levelKey": "L",
+				"levelEncoder": "lowercase"
+			},
+			"msgpack": {
+				"entryTime": "epoch",
+				"tagPrefix": "app.",
+				"tagFromLoggerName": true
+			}
+		}`), &cfg); err != nil {
+			return nil, err
+		}
+
+		return cfg.Build()
+	})
+
+	entries := decodeEntryStream(out)
+	require.Len(t, entries, 1)
+
+	entry := entries[0].([]interface{})
+	require.Len(t, entry, 3)
+
+	assert.Equal(t, "app.db", entry[0])
+	assert.EqualValues(t, map[string]interface{}{
+		"L": "info",
+		"M": "lob law",
+		"i": int64(1),
+	}, entry[2])
+}
+
+func TestConfigInvalidOptions(t *testing.T) {
+	cfg := zapmsgpack.Config{Config: zap.NewProductionConfig()}
+	cfg.Encoding = zapmsgpack.EncoderName
+	cfg.Msgpack.EntryTime = "sundial"
+
+	_, err := cfg.Build()
+	assert.EqualError(t, err, `zapmsgpack: unknown entry time encoding "sundial"`)
+
+	cfg.Msgpack = zapmsgpack.EncoderOptions{TagPrefix: "app."}
+
+	_, err = cfg.Build()
+	assert.Error(t, err)
+
+	cfg.Encoding = "json"
+	cfg.Msgpack = zapmsgpack.EncoderOptions{}
+
+	_, err = cfg.Build()
+	assert.NoError(t, err)
+}
+
+func strconvQuote(s string) string {
+	b, _ := json.Marshal(s)
+
+	return string(b)
+}
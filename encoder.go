@@ -21,117 +21,355 @@
 package zapmsgpack
 
 import (
-	"bytes"
+	"encoding/binary"
+	"math"
 	"sync"
+	"time"
 
-	"github.com/vmihailenco/msgpack"
 	"go.uber.org/zap/buffer"
 	"go.uber.org/zap/zapcore"
 )
 
-const initialSize = 1024
-
 type encoder struct {
 	*zapcore.EncoderConfig
+	opts *options
 
-	buf      *bytes.Buffer
-	enc      *msgpack.Encoder
+	buf      *buffer.Buffer
 	mapSize  int
 	sliceLen int
-	nsPrefix string
+	openMaps []openMap
+
+	// flat namespaces prefix, keys of the current object
+	// are prefixed with nsPrefix[nsPrefixStart:]
+	nsPrefix      []byte
+	nsPrefixStart int
+
+	// message tag field pulled out of the context
+	tag    string
+	hasTag bool
+	// entry fields along with the context tag field passed to TagResolver
+	tagFields []zapcore.Field
+
+	// scratch space for append-style primitives
+	scratch [32]byte
+}
+
+// openMap is a map being encoded, its size is back-patched on close.
+//
+// Open maps are namespaces and the top-level record map.
+type openMap struct {
+	// offset of map32 header in the buffer
+	offset int
+	// size of the enclosing map
+	mapSize int
 }
 
+// map32 and array32 headers with zero length, real length is written when
+// container is closed.
+var (
+	map32Header   = [5]byte{map32Code}
+	array32Header = [5]byte{array32Code}
+)
+
 var bufPool = buffer.NewPool()
 
 var encoderPool = sync.Pool{
 	New: func() interface{} {
-		enc := &encoder{
-			buf: bytes.NewBuffer(make([]byte, 0, initialSize)),
-		}
-
-		enc.enc = msgpack.NewEncoder(enc.buf)
-
-		return enc
+		return &encoder{}
 	},
 }
 
 func getEncoder() *encoder {
-	return encoderPool.Get().(*encoder)
+	enc := encoderPool.Get().(*encoder)
+	enc.buf = bufPool.Get()
+
+	return enc
 }
 
 func putEncoder(enc *encoder) {
-	enc.buf.Reset()
+	if enc.buf != nil {
+		enc.buf.Free()
+		enc.buf = nil
+	}
+
 	enc.EncoderConfig = nil
+	enc.opts = nil
 	enc.mapSize = 0
 	enc.sliceLen = 0
-	enc.nsPrefix = ""
+	enc.nsPrefix = enc.nsPrefix[:0]
+	enc.nsPrefixStart = 0
+	enc.openMaps = enc.openMaps[:0]
+	enc.tag, enc.hasTag = "", false
+
+	for i := range enc.tagFields {
+		enc.tagFields[i] = zapcore.Field{}
+	}
+	enc.tagFields = enc.tagFields[:0]
 
 	encoderPool.Put(enc)
 }
 
+// truncate discards buffer contents after first n bytes.
+func truncate(buf *buffer.Buffer, n int) {
+	b := buf.Bytes()[:n]
+	buf.Reset()
+	_, _ = buf.Write(b)
+}
+
 // NewEncoder creates fast, low-allocation msgpack encoder
 //
 // Msgpack encoder could be used e.g. while delivering go.uber.org/zap logs
 // to fluentd destination.
-func NewEncoder(cfg zapcore.EncoderConfig) zapcore.Encoder {
+//
+// Encoder behavior could be tuned with Options.
+func NewEncoder(cfg zapcore.EncoderConfig, opts ...Option) zapcore.Encoder {
 	enc := getEncoder()
 	enc.EncoderConfig = &cfg
+	enc.opts = newOptions(opts)
 
 	return enc
 }
 
+// write appends the output of append-style primitive to the buffer.
+//
+// Primitives should append to enc.scratch[:0].
+func (enc *encoder) write(b []byte) {
+	_, _ = enc.buf.Write(b)
+}
+
+func (enc *encoder) encodeString(val string) {
+	enc.write(appendStrHeader(enc.scratch[:0], len(val)))
+	enc.buf.AppendString(val)
+}
+
+func (enc *encoder) encodeByteString(val []byte) {
+	enc.write(appendStrHeader(enc.scratch[:0], len(val)))
+	enc.write(val)
+}
+
+func (enc *encoder) encodeBytes(val []byte) {
+	if val == nil {
+		enc.write(appendNil(enc.scratch[:0]))
+		return
+	}
+
+	enc.write(appendBinHeader(enc.scratch[:0], len(val)))
+	enc.write(val)
+}
+
+// encodeKey writes the key prefixed with open flat namespaces.
 func (enc *encoder) encodeKey(key string) {
-	_ = enc.enc.EncodeString(enc.nsPrefix + key)
+	prefix := enc.nsPrefix[enc.nsPrefixStart:]
+
+	enc.write(appendStrHeader(enc.scratch[:0], len(prefix)+len(key)))
+	enc.write(prefix)
+	enc.buf.AppendString(key)
 }
 
-func (enc *encoder) encodeArray(arr zapcore.ArrayMarshaler) error {
-	sliceEnc := enc.clone()
-	if err := arr.MarshalLogArray(sliceEnc); err != nil {
-		return err
+func (enc *encoder) encodeTime(val time.Time, timeEncoder zapcore.TimeEncoder) {
+	cur := enc.buf.Len()
+	sliceLen := enc.sliceLen
+
+	if timeEncoder != nil {
+		timeEncoder(val, enc)
 	}
 
-	if err := enc.enc.EncodeArrayLen(sliceEnc.sliceLen); err != nil {
-		return err
+	// value appended by timeEncoder is already accounted for by the caller
+	enc.sliceLen = sliceLen
+
+	if cur == enc.buf.Len() {
+		// User-supplied timeEncoder was a no-op. Fall back to msgpack
+		// timestamp extension to keep output valid.
+		enc.write(appendTimestamp(enc.scratch[:0], val))
 	}
+}
+
+func (enc *encoder) encodeDuration(val time.Duration) {
+	cur := enc.buf.Len()
+	sliceLen := enc.sliceLen
 
-	if _, err := enc.buf.Write(sliceEnc.buf.Bytes()); err != nil {
-		return err
+	if enc.EncodeDuration != nil {
+		enc.EncodeDuration(val, enc)
 	}
 
-	putEncoder(sliceEnc)
+	// value appended by EncodeDuration is already accounted for by the caller
+	enc.sliceLen = sliceLen
 
-	return nil
+	if cur == enc.buf.Len() {
+		// User-supplied EncodeDuration was a no-op. Fall back to seconds to
+		// keep output valid.
+		enc.write(appendFloat64(enc.scratch[:0], val.Seconds()))
+	}
 }
 
-func (enc *encoder) encodeObject(obj zapcore.ObjectMarshaler) error {
-	mapEnc := enc.clone()
-	if err := obj.MarshalLogObject(mapEnc); err != nil {
-		return err
+func (enc *encoder) encodeComplex128(val complex128) {
+	b := enc.scratch[:0]
+
+	if enc.opts.complexExt {
+		b = appendExtHeader(b, enc.opts.complexExtType, 16)
+		b = appendBigEndian64(b, math.Float64bits(real(val)))
+		b = appendBigEndian64(b, math.Float64bits(imag(val)))
+	} else {
+		b = appendArrayHeader(b, 2)
+		b = appendFloat64(b, real(val))
+		b = appendFloat64(b, imag(val))
 	}
 
-	if err := enc.enc.EncodeMapLen(mapEnc.mapSize); err != nil {
-		return err
-	}
+	enc.write(b)
+}
 
-	if _, err := enc.buf.Write(mapEnc.buf.Bytes()); err != nil {
-		return err
+func (enc *encoder) encodeComplex64(val complex64) {
+	b := enc.scratch[:0]
+
+	if enc.opts.complexExt {
+		b = appendExtHeader(b, enc.opts.complexExtType, 8)
+		b = appendBigEndian32(b, math.Float32bits(real(val)))
+		b = appendBigEndian32(b, math.Float32bits(imag(val)))
+	} else {
+		b = appendArrayHeader(b, 2)
+		b = appendFloat32(b, real(val))
+		b = appendFloat32(b, imag(val))
 	}
 
-	putEncoder(mapEnc)
+	enc.write(b)
+}
+
+// encodeArray encodes array elements in place, array length is patched afterwards.
+func (enc *encoder) encodeArray(arr zapcore.ArrayMarshaler) error {
+	offset := enc.buf.Len()
+	sliceLen := enc.sliceLen
+	enc.sliceLen = 0
 
-	return nil
+	_, _ = enc.buf.Write(array32Header[:])
+
+	err := arr.MarshalLogArray(enc)
+
+	enc.closeContainer(offset, enc.sliceLen, fixArrayCode, array16Code)
+	enc.sliceLen = sliceLen
+
+	return err
+}
+
+// encodeObject encodes object fields in place, map size is patched afterwards.
+func (enc *encoder) encodeObject(obj zapcore.ObjectMarshaler) error {
+	depth := len(enc.openMaps)
+	// object keys are not prefixed with enclosing namespaces
+	nsPrefixLen, nsPrefixStart := len(enc.nsPrefix), enc.nsPrefixStart
+	enc.nsPrefixStart = nsPrefixLen
+
+	enc.openMap()
+
+	err := obj.MarshalLogObject(enc)
+
+	// close namespaces opened by the object along with the object itself
+	enc.closeMaps(depth)
+	enc.nsPrefix, enc.nsPrefixStart = enc.nsPrefix[:nsPrefixLen], nsPrefixStart
+
+	return err
 }
 
 // OpenNamespace opens an isolated namespace where all subsequent fields will
 // be added. Applications can use namespaces to prevent key collisions when
 // injecting loggers into sub-components or third-party libraries.
+//
+// Namespace is encoded as nested map unless WithFlatNamespaces option is used.
 func (enc *encoder) OpenNamespace(key string) {
-	enc.nsPrefix += key + "."
+	if enc.opts.flatNamespaces {
+		enc.nsPrefix = append(append(enc.nsPrefix, key...), '.')
+		return
+	}
+
+	enc.mapSize++
+	enc.encodeKey(key)
+	enc.openMap()
+}
+
+// openMap starts a map of unknown size, all subsequent fields are added to it.
+func (enc *encoder) openMap() {
+	enc.openMaps = append(enc.openMaps, openMap{
+		offset:  enc.buf.Len(),
+		mapSize: enc.mapSize,
+	})
+	enc.mapSize = 0
+
+	_, _ = enc.buf.Write(map32Header[:])
+}
+
+// closeMaps patches sizes of open maps, innermost first, leaving depth maps open.
+func (enc *encoder) closeMaps(depth int) {
+	for i := len(enc.openMaps) - 1; i >= depth; i-- {
+		enc.closeContainer(enc.openMaps[i].offset, enc.mapSize, fixMapCode, map16Code)
+		enc.mapSize = enc.openMaps[i].mapSize
+	}
+
+	enc.openMaps = enc.openMaps[:depth]
+}
+
+// closeContainer writes size of the array or map which 32-bit header was reserved at offset.
+//
+// Container should end at the end of the buffer. With WithCompactHeaders option header
+// is replaced with the shortest one, and container contents are moved back.
+func (enc *encoder) closeContainer(offset, size int, fixCode, code16 byte) {
+	b := enc.buf.Bytes()
+
+	var n int
+
+	switch {
+	case !enc.opts.compactHeaders || size > math.MaxUint16:
+		binary.BigEndian.PutUint32(b[offset+1:], uint32(size))
+		return
+	case size < 16:
+		b[offset] = fixCode | byte(size)
+		n = 1
+	default:
+		b[offset] = code16
+		binary.BigEndian.PutUint16(b[offset+1:], uint16(size))
+		n = 3
+	}
+
+	copy(b[offset+n:], b[offset+len(map32Header):])
+	truncate(enc.buf, len(b)-len(map32Header)+n)
+}
+
+// isTagLevel returns true if fields are added to the top level of the record,
+// where message tag field is looked up.
+func (enc *encoder) isTagLevel() bool {
+	return len(enc.openMaps) == 0 && len(enc.nsPrefix) == 0
+}
+
+// isTagField returns true if the field should be pulled out of the record
+// into the message tag.
+func (enc *encoder) isTagField(key string, typ zapcore.FieldType) bool {
+	return enc.opts.messageTagKey != "" && key == enc.opts.messageTagKey && typ == zapcore.StringType
+}
+
+// resolveTag resolves message tag, tag field of the context is passed to the
+// resolver ahead of the entry fields.
+//
+// final provides scratch space for the fields.
+func (enc *encoder) resolveTag(final *encoder, ent zapcore.Entry, fields []zapcore.Field) string {
+	if enc.opts.messageTagKey != "" && !enc.isTagLevel() {
+		// entry fields go to the namespace, so tag field is never pulled out
+		fields = nil
+	}
+
+	if enc.hasTag {
+		final.tagFields = append(final.tagFields, zapcore.Field{
+			Key:    enc.opts.messageTagKey,
+			Type:   zapcore.StringType,
+			String: enc.tag,
+		})
+		final.tagFields = append(final.tagFields, fields...)
+		fields = final.tagFields
+	}
+
+	return enc.opts.messageTag.ResolveTag(ent, fields)
 }
 
 func (enc *encoder) clone() *encoder {
 	clone := getEncoder()
 	clone.EncoderConfig = enc.EncoderConfig
+	clone.opts = enc.opts
 
 	return clone
 }
@@ -143,7 +381,9 @@ func (enc *encoder) Clone() zapcore.Encoder {
 	_, _ = clone.buf.Write(enc.buf.Bytes())
 	clone.mapSize = enc.mapSize
 	clone.sliceLen = enc.sliceLen
-	clone.nsPrefix = enc.nsPrefix
+	clone.nsPrefix = append(clone.nsPrefix, enc.nsPrefix...)
+	clone.openMaps = append(clone.openMaps, enc.openMaps...)
+	clone.tag, clone.hasTag = enc.tag, enc.hasTag
 	return clone
 }
 
@@ -154,23 +394,48 @@ func (enc *encoder) Clone() zapcore.Encoder {
 // https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
 //
 // [ timestamp, {key : value, ... } ]
+//
+// With WithMessageMode option message is serialized as "Message":
+//
+// [ tag, timestamp, {key : value, ... } ]
+//
+// Fields which fail to marshal are replaced with "<key>Error" string field
+// (same way zap JSON encoder does).
+//
+// Timestamp is encoded as msgpack timestamp extension unless overridden with
+// WithEntryTimeEncoder option. EncoderConfig.EncodeTime is used only for
+// time fields, as it might produce timestamp fluentd doesn't accept
+// (e.g. ISO8601 string).
 func (enc *encoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
-	finenc := enc.clone()
+	final := enc.clone()
+	defer putEncoder(final)
 
-	_ = finenc.enc.EncodeArrayLen(2)
-	_ = finenc.enc.EncodeTime(ent.Time)
+	entryTimeEncoder := zapcore.TimeEncoder(TimestampTimeEncoder)
+	if enc.opts.entryTimeEncoder != nil {
+		entryTimeEncoder = enc.opts.entryTimeEncoder
+	}
 
-	final := enc.clone()
+	if enc.opts.messageTag != nil {
+		final.write(appendArrayHeader(final.scratch[:0], 3))
+		final.encodeString(enc.resolveTag(final, ent, fields))
+	} else {
+		final.write(appendArrayHeader(final.scratch[:0], 2))
+	}
+
+	final.encodeTime(ent.Time, entryTimeEncoder)
+
+	// record map size is not known in advance, it is patched when the map is closed
+	final.openMap()
 
 	if final.LevelKey != "" {
 		final.mapSize++
-		_ = final.enc.EncodeString(final.LevelKey)
+		final.encodeString(final.LevelKey)
 		cur := final.buf.Len()
 		final.EncodeLevel(ent.Level, final)
 		if cur == final.buf.Len() {
 			// User-supplied EncodeLevel was a no-op. Fall back to strings to keep
 			// output JSON valid.
-			_ = final.enc.EncodeString(ent.Level.String())
+			final.encodeString(ent.Level.String())
 		}
 	}
 	if final.TimeKey != "" {
@@ -178,7 +443,7 @@ func (enc *encoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buf
 	}
 	if ent.LoggerName != "" && final.NameKey != "" {
 		final.mapSize++
-		_ = final.enc.EncodeString(final.NameKey)
+		final.encodeString(final.NameKey)
 		cur := final.buf.Len()
 		nameEncoder := final.EncodeName
 
@@ -192,42 +457,70 @@ func (enc *encoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buf
 		if cur == final.buf.Len() {
 			// User-supplied EncodeName was a no-op. Fall back to strings to
 			// keep output valid.
-			_ = final.enc.EncodeString(ent.LoggerName)
+			final.encodeString(ent.LoggerName)
 		}
 	}
 	if ent.Caller.Defined && final.CallerKey != "" {
 		final.mapSize++
-		_ = final.enc.EncodeString(final.CallerKey)
+		final.encodeString(final.CallerKey)
 		cur := final.buf.Len()
 		final.EncodeCaller(ent.Caller, final)
 		if cur == final.buf.Len() {
 			// User-supplied EncodeCaller was a no-op. Fall back to strings to
 			// keep output valid.
-			_ = final.enc.EncodeString(ent.Caller.String())
+			final.encodeString(ent.Caller.String())
 		}
 	}
 	if final.MessageKey != "" {
 		final.mapSize++
-		_ = final.enc.EncodeString(enc.MessageKey)
-		_ = final.enc.EncodeString(ent.Message)
+		final.encodeString(enc.MessageKey)
+		final.encodeString(ent.Message)
+	}
+
+	// accumulated context follows entry metadata in the record map,
+	// fields are added to the namespaces left open by the context
+	offset := final.buf.Len()
+	_, _ = final.buf.Write(enc.buf.Bytes())
+
+	if len(enc.openMaps) == 0 {
+		final.mapSize += enc.mapSize
+	} else {
+		for _, m := range enc.openMaps {
+			final.openMaps = append(final.openMaps, openMap{
+				offset:  offset + m.offset,
+				mapSize: m.mapSize,
+			})
+		}
+
+		final.openMaps[1].mapSize += final.mapSize
+		final.mapSize = enc.mapSize
 	}
 
+	final.nsPrefix = append(final.nsPrefix, enc.nsPrefix...)
+
+	pullTag := enc.isTagLevel()
+
 	for i := range fields {
+		if pullTag && enc.isTagField(fields[i].Key, fields[i].Type) {
+			continue
+		}
+
 		fields[i].AddTo(final)
 	}
 
+	// close namespaces, stacktrace goes to the record map
+	final.closeMaps(1)
+	final.nsPrefix = final.nsPrefix[:0]
+
 	if ent.Stack != "" && final.StacktraceKey != "" {
 		final.AddString(final.StacktraceKey, ent.Stack)
 	}
 
-	_ = finenc.enc.EncodeMapLen(final.mapSize)
-	_, _ = finenc.buf.Write(final.buf.Bytes())
-
-	buf := bufPool.Get()
-	_, _ = buf.Write(finenc.buf.Bytes())
+	final.closeMaps(0)
 
-	putEncoder(final)
-	putEncoder(finenc)
+	// buffer is handed over to the caller
+	buf := final.buf
+	final.buf = nil
 
 	return buf, nil
 }
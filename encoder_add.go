@@ -27,145 +27,183 @@ import (
 )
 
 func (enc *encoder) AddArray(key string, arr zapcore.ArrayMarshaler) error {
+	mark := enc.buf.Len()
 	enc.mapSize++
 	enc.encodeKey(key)
 
-	return enc.encodeArray(arr)
+	if err := enc.encodeArray(arr); err != nil {
+		// drop the key along with partially encoded value
+		truncate(enc.buf, mark)
+		enc.mapSize--
+
+		return err
+	}
+
+	return nil
 }
 
 func (enc *encoder) AddObject(key string, obj zapcore.ObjectMarshaler) error {
+	mark := enc.buf.Len()
 	enc.mapSize++
 	enc.encodeKey(key)
 
-	return enc.encodeObject(obj)
+	if err := enc.encodeObject(obj); err != nil {
+		// drop the key along with partially encoded value
+		truncate(enc.buf, mark)
+		enc.mapSize--
+
+		return err
+	}
+
+	return nil
 }
 
 func (enc *encoder) AddBinary(key string, val []byte) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeBytes(val)
+	enc.encodeBytes(val)
 }
 
 func (enc *encoder) AddByteString(key string, val []byte) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeString(string(val))
+	enc.encodeByteString(val)
 }
 
 func (enc *encoder) AddBool(key string, val bool) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeBool(val)
+	enc.write(appendBool(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddComplex128(key string, val complex128) {
-	panic("complex numbers not supported in msgpack")
+	enc.mapSize++
+	enc.encodeKey(key)
+	enc.encodeComplex128(val)
 }
 
 func (enc *encoder) AddComplex64(key string, val complex64) {
-	panic("complex numbers not supported in msgpack")
+	enc.mapSize++
+	enc.encodeKey(key)
+	enc.encodeComplex64(val)
 }
 
 func (enc *encoder) AddDuration(key string, val time.Duration) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeFloat64(val.Seconds())
+	enc.encodeDuration(val)
 }
 
 func (enc *encoder) AddFloat64(key string, val float64) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeFloat64(val)
+	enc.write(appendFloat64(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddFloat32(key string, val float32) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeFloat32(val)
+	enc.write(appendFloat32(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddInt(key string, val int) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeInt(int64(val))
+	enc.write(appendInt(enc.scratch[:0], int64(val)))
 }
 
 func (enc *encoder) AddInt64(key string, val int64) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeInt64(val)
+	enc.write(appendInt64(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddInt32(key string, val int32) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeInt32(val)
+	enc.write(appendInt32(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddInt16(key string, val int16) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeInt16(val)
+	enc.write(appendInt16(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddInt8(key string, val int8) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeInt8(val)
+	enc.write(appendInt8(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddString(key string, val string) {
+	if enc.isTagField(key, zapcore.StringType) && enc.isTagLevel() {
+		// context field is pulled out of the record into the message tag
+		enc.tag, enc.hasTag = val, true
+		return
+	}
+
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeString(val)
+	enc.encodeString(val)
 }
 
 func (enc *encoder) AddTime(key string, val time.Time) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeTime(val)
+	enc.encodeTime(val, enc.EncodeTime)
 }
 
 func (enc *encoder) AddUint(key string, val uint) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeUint(uint64(val))
+	enc.write(appendUint(enc.scratch[:0], uint64(val)))
 }
 
 func (enc *encoder) AddUint64(key string, val uint64) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeUint64(val)
+	enc.write(appendUint64(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddUint32(key string, val uint32) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeUint32(val)
+	enc.write(appendUint32(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddUint16(key string, val uint16) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeUint16(val)
+	enc.write(appendUint16(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddUint8(key string, val uint8) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeUint8(val)
+	enc.write(appendUint8(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AddUintptr(key string, val uintptr) {
 	enc.mapSize++
 	enc.encodeKey(key)
-	_ = enc.enc.EncodeUint(uint64(val))
+	enc.write(appendUint(enc.scratch[:0], uint64(val)))
 }
 
 // AddReflected uses reflection to serialize arbitrary objects, so it's slow
 // and allocation-heavy.
 func (enc *encoder) AddReflected(key string, val interface{}) error {
+	mark := enc.buf.Len()
 	enc.mapSize++
 	enc.encodeKey(key)
-	return enc.enc.Encode(val)
+
+	if err := enc.encodeReflected(val); err != nil {
+		// drop the key along with partially encoded value
+		truncate(enc.buf, mark)
+		enc.mapSize--
+
+		return err
+	}
+
+	return nil
 }
@@ -27,111 +27,143 @@ import (
 )
 
 func (enc *encoder) AppendArray(arr zapcore.ArrayMarshaler) error {
+	mark := enc.buf.Len()
 	enc.sliceLen++
-	return enc.encodeArray(arr)
+
+	if err := enc.encodeArray(arr); err != nil {
+		// drop partially encoded value
+		truncate(enc.buf, mark)
+		enc.sliceLen--
+
+		return err
+	}
+
+	return nil
 }
 
 func (enc *encoder) AppendObject(obj zapcore.ObjectMarshaler) error {
+	mark := enc.buf.Len()
 	enc.sliceLen++
-	return enc.encodeObject(obj)
+
+	if err := enc.encodeObject(obj); err != nil {
+		// drop partially encoded value
+		truncate(enc.buf, mark)
+		enc.sliceLen--
+
+		return err
+	}
+
+	return nil
 }
 
 func (enc *encoder) AppendBool(val bool) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeBool(val)
+	enc.write(appendBool(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendByteString(val []byte) { // for UTF-8 encoded bytes
 	enc.sliceLen++
-	_ = enc.enc.EncodeString(string(val))
+	enc.encodeByteString(val)
 }
 
-func (enc *encoder) AppendComplex128(complex128) {
-	panic("not implemented")
+func (enc *encoder) AppendComplex128(val complex128) {
+	enc.sliceLen++
+	enc.encodeComplex128(val)
 }
 
-func (enc *encoder) AppendComplex64(complex64) {
-	panic("not implemented")
+func (enc *encoder) AppendComplex64(val complex64) {
+	enc.sliceLen++
+	enc.encodeComplex64(val)
 }
 
 func (enc *encoder) AppendDuration(val time.Duration) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeFloat64(val.Seconds())
+	enc.encodeDuration(val)
 }
 
 func (enc *encoder) AppendFloat64(val float64) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeFloat64(val)
+	enc.write(appendFloat64(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendFloat32(val float32) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeFloat32(val)
+	enc.write(appendFloat32(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendInt(val int) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeInt(int64(val))
+	enc.write(appendInt(enc.scratch[:0], int64(val)))
 }
 
 func (enc *encoder) AppendInt64(val int64) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeInt64(val)
+	enc.write(appendInt64(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendInt32(val int32) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeInt32(val)
+	enc.write(appendInt32(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendInt16(val int16) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeInt16(val)
+	enc.write(appendInt16(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendInt8(val int8) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeInt8(val)
+	enc.write(appendInt8(enc.scratch[:0], val))
 }
 func (enc *encoder) AppendString(val string) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeString(val)
+	enc.encodeString(val)
 }
 
 func (enc *encoder) AppendTime(val time.Time) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeTime(val)
+	enc.encodeTime(val, enc.EncodeTime)
 }
 
 func (enc *encoder) AppendUint(val uint) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeUint(uint64(val))
+	enc.write(appendUint(enc.scratch[:0], uint64(val)))
 }
 
 func (enc *encoder) AppendUint64(val uint64) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeUint64(val)
+	enc.write(appendUint64(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendUint32(val uint32) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeUint32(val)
+	enc.write(appendUint32(enc.scratch[:0], val))
 }
 func (enc *encoder) AppendUint16(val uint16) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeUint16(val)
+	enc.write(appendUint16(enc.scratch[:0], val))
 }
 
 func (enc *encoder) AppendUint8(val uint8) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeUint8(val)
+	enc.write(appendUint8(enc.scratch[:0], val))
 }
 func (enc *encoder) AppendUintptr(val uintptr) {
 	enc.sliceLen++
-	_ = enc.enc.EncodeUint64(uint64(val))
+	enc.write(appendUint64(enc.scratch[:0], uint64(val)))
 }
 
 func (enc *encoder) AppendReflected(val interface{}) error {
+	mark := enc.buf.Len()
 	enc.sliceLen++
-	return enc.enc.Encode(val)
+
+	if err := enc.encodeReflected(val); err != nil {
+		// drop partially encoded value
+		truncate(enc.buf, mark)
+		enc.sliceLen--
+
+		return err
+	}
+
+	return nil
 }
@@ -21,6 +21,9 @@
 package zapmsgpack_test
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"testing"
 	"time"
 
@@ -28,6 +31,7 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/vmihailenco/msgpack"
 
 	zapmsgpack "github.com/smira/zap-msgpack-encoder"
@@ -47,6 +51,7 @@ func TestEncodeEntry(t *testing.T) {
 	}
 
 	ts := time.Date(2018, 6, 19, 16, 33, 42, 99, time.Local)
+	tsStr := ts.Format("2006-01-02T15:04:05.000Z0700")
 
 	tests := []struct {
 		desc     string
@@ -60,7 +65,7 @@ func TestEncodeEntry(t *testing.T) {
 				&ts,
 				map[string]interface{}{
 					"L":          "info",
-					"T":          &ts,
+					"T":          tsStr,
 					"N":          "bob",
 					"M":          "lob law",
 					"so":         "passes",
@@ -104,7 +109,7 @@ func TestEncodeEntry(t *testing.T) {
 				&ts,
 				map[string]interface{}{
 					"L":    "debug",
-					"T":    &ts,
+					"T":    tsStr,
 					"M":    "lob law",
 					"so":   "passes",
 					"arr1": []interface{}{},
@@ -154,7 +159,7 @@ func TestEncodeEntry(t *testing.T) {
 				&ts,
 				map[string]interface{}{
 					"L":    "debug",
-					"T":    &ts,
+					"T":    tsStr,
 					"M":    "",
 					"d":    0.5,
 					"obj1": map[string]interface{}{},
@@ -228,3 +233,736 @@ func TestEncodeEntry(t *testing.T) {
 		})
 	}
 }
+
+func TestTimeEncoders(t *testing.T) {
+	ts := time.Date(2018, 6, 19, 16, 33, 42, 99, time.UTC)
+	tsLocal := ts.Local() // msgpack timestamp is decoded in local timezone
+
+	tests := []struct {
+		desc     string
+		encoder  zapcore.TimeEncoder
+		expected interface{}
+	}{
+		{
+			desc:     "timestamp",
+			encoder:  zapmsgpack.TimestampTimeEncoder,
+			expected: &tsLocal,
+		},
+		{
+			desc:     "nil",
+			encoder:  nil,
+			expected: &tsLocal,
+		},
+		{
+			desc:     "epoch seconds",
+			encoder:  zapmsgpack.EpochSecondsTimeEncoder,
+			expected: int64(1529426022),
+		},
+		{
+			desc:     "epoch float",
+			encoder:  zapmsgpack.EpochFloatTimeEncoder,
+			expected: 1529426022.000000099,
+		},
+		{
+			desc:     "epoch millis",
+			encoder:  zapmsgpack.EpochMillisTimeEncoder,
+			expected: int64(1529426022000),
+		},
+		{
+			desc:     "epoch nanos",
+			encoder:  zapmsgpack.EpochNanosTimeEncoder,
+			expected: int64(1529426022000000099),
+		},
+		{
+			desc:     "rfc3339",
+			encoder:  zapmsgpack.RFC3339TimeEncoder,
+			expected: "2018-06-19T16:33:42Z",
+		},
+		{
+			desc:     "rfc3339nano",
+			encoder:  zapmsgpack.RFC3339NanoTimeEncoder,
+			expected: "2018-06-19T16:33:42.000000099Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{
+				TimeKey:    "T",
+				EncodeTime: tt.encoder,
+			})
+
+			buf, err := enc.EncodeEntry(zapcore.Entry{Time: ts}, []zapcore.Field{
+				zap.Times("times", []time.Time{ts, ts}),
+			})
+
+			if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+				var v []interface{}
+
+				err = msgpack.Unmarshal(buf.Bytes(), &v)
+				if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+					// entry timestamp doesn't depend on EncodeTime
+					assert.EqualValues(t, []interface{}{
+						&tsLocal,
+						map[string]interface{}{
+							"T":     tt.expected,
+							"times": []interface{}{tt.expected, tt.expected},
+						},
+					}, v, "Incorrect encoded msgpack entry")
+				}
+			}
+			buf.Free()
+		})
+	}
+}
+
+func TestEventTimeEncoder(t *testing.T) {
+	ts := time.Date(2018, 6, 19, 16, 33, 42, 99, time.UTC)
+
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{
+		TimeKey:    "T",
+		EncodeTime: zapmsgpack.EventTimeEncoder,
+	})
+
+	buf, err := enc.EncodeEntry(zapcore.Entry{Time: ts}, nil)
+	if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+		eventTime := []byte{0xd7, 0x00, 0x5b, 0x29, 0x30, 0x66, 0x00, 0x00, 0x00, 0x63}
+		// msgpack timestamp extension
+		timestamp := []byte{0xd7, 0xff, 0x00, 0x00, 0x01, 0x8c, 0x5b, 0x29, 0x30, 0x66}
+
+		expected := []byte{0x92}
+		expected = append(expected, timestamp...)
+		expected = append(expected, 0xdf, 0, 0, 0, 1, 0xa1, 'T')
+		expected = append(expected, eventTime...)
+
+		assert.Equal(t, expected, buf.Bytes())
+	}
+	buf.Free()
+}
+
+func TestEntryTimeEncoder(t *testing.T) {
+	ts := time.Date(2018, 6, 19, 16, 33, 42, 99, time.UTC)
+
+	cfg := zapcore.EncoderConfig{
+		TimeKey:    "T",
+		EncodeTime: zapcore.ISO8601TimeEncoder,
+	}
+
+	t.Run("event time", func(t *testing.T) {
+		enc := zapmsgpack.NewEncoder(cfg, zapmsgpack.WithEventTime())
+
+		buf, err := enc.EncodeEntry(zapcore.Entry{Time: ts}, nil)
+		if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+			expected := []byte{0x92, 0xd7, 0x00, 0x5b, 0x29, 0x30, 0x66, 0x00, 0x00, 0x00, 0x63, 0xdf, 0, 0, 0, 1, 0xa1, 'T', 0xb8}
+			expected = append(expected, "2018-06-19T16:33:42.000Z"...)
+
+			assert.Equal(t, expected, buf.Bytes())
+		}
+		buf.Free()
+	})
+
+	t.Run("epoch", func(t *testing.T) {
+		enc := zapmsgpack.NewEncoder(cfg, zapmsgpack.WithEpochTime())
+
+		buf, err := enc.EncodeEntry(zapcore.Entry{Time: ts}, nil)
+		if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+			var v []interface{}
+
+			err = msgpack.Unmarshal(buf.Bytes(), &v)
+			if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+				assert.EqualValues(t, []interface{}{
+					int64(1529426022),
+					map[string]interface{}{"T": "2018-06-19T16:33:42.000Z"},
+				}, v, "Incorrect encoded msgpack entry")
+			}
+		}
+		buf.Free()
+	})
+}
+
+func TestDurationEncoders(t *testing.T) {
+	tests := []struct {
+		desc     string
+		encoder  zapcore.DurationEncoder
+		expected interface{}
+	}{
+		{
+			desc:     "nil",
+			encoder:  nil,
+			expected: 1.5,
+		},
+		{
+			desc:     "no-op",
+			encoder:  func(time.Duration, zapcore.PrimitiveArrayEncoder) {},
+			expected: 1.5,
+		},
+		{
+			desc:     "seconds",
+			encoder:  zapcore.SecondsDurationEncoder,
+			expected: 1.5,
+		},
+		{
+			desc:     "nanos",
+			encoder:  zapcore.NanosDurationEncoder,
+			expected: int64(1500000000),
+		},
+		{
+			desc:     "string",
+			encoder:  zapcore.StringDurationEncoder,
+			expected: "1.5s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{
+				EncodeDuration: tt.encoder,
+			}, zapmsgpack.WithEpochTime())
+
+			buf, err := enc.EncodeEntry(zapcore.Entry{}, []zapcore.Field{
+				zap.Duration("d", 1500*time.Millisecond),
+				zap.Durations("ds", []time.Duration{1500 * time.Millisecond, 1500 * time.Millisecond}),
+			})
+
+			if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+				var v []interface{}
+
+				err = msgpack.Unmarshal(buf.Bytes(), &v)
+				if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+					assert.EqualValues(t, map[string]interface{}{
+						"d":  tt.expected,
+						"ds": []interface{}{tt.expected, tt.expected},
+					}, v[1], "Incorrect encoded msgpack entry")
+				}
+			}
+			buf.Free()
+		})
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	cfg := zapcore.EncoderConfig{
+		MessageKey:    "M",
+		StacktraceKey: "S",
+	}
+
+	ent := zapcore.Entry{
+		Message: "lob law",
+		Stack:   "stack",
+	}
+
+	tests := []struct {
+		desc     string
+		opts     []zapmsgpack.Option
+		expected map[string]interface{}
+		original map[string]interface{}
+	}{
+		{
+			desc: "nested",
+			original: map[string]interface{}{
+				"M":   "",
+				"ctx": "v",
+				"http": map[string]interface{}{
+					"status": int64(200),
+					"code":   int64(404),
+				},
+			},
+			expected: map[string]interface{}{
+				"M":   "lob law",
+				"ctx": "v",
+				"http": map[string]interface{}{
+					"status": int64(200),
+					"req": map[string]interface{}{
+						"id":  "abc",
+						"foo": "bar",
+						"obj": map[string]interface{}{
+							"a": true,
+							"inobj": map[string]interface{}{
+								"b": false,
+							},
+						},
+						"inner": map[string]interface{}{
+							"x": int64(1),
+						},
+					},
+				},
+				"S": "stack",
+			},
+		},
+		{
+			desc: "flat",
+			opts: []zapmsgpack.Option{zapmsgpack.WithFlatNamespaces()},
+			original: map[string]interface{}{
+				"M":           "",
+				"ctx":         "v",
+				"http.status": int64(200),
+				"http.code":   int64(404),
+			},
+			expected: map[string]interface{}{
+				"M":                "lob law",
+				"ctx":              "v",
+				"http.status":      int64(200),
+				"http.req.id":      "abc",
+				"http.req.foo":     "bar",
+				"http.req.inner.x": int64(1),
+				"http.req.obj": map[string]interface{}{
+					"a":       true,
+					"inobj.b": false,
+				},
+				"S": "stack",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			enc := zapmsgpack.NewEncoder(cfg, append(tt.opts, zapmsgpack.WithEpochTime())...)
+			enc.AddString("ctx", "v")
+			enc.OpenNamespace("http")
+			enc.AddInt64("status", 200)
+
+			clone := enc.Clone()
+			clone.OpenNamespace("req")
+			clone.AddString("id", "abc")
+
+			for i := 0; i < 2; i++ {
+				buf, err := clone.EncodeEntry(ent, []zapcore.Field{
+					zap.String("foo", "bar"),
+					zap.Object("obj", zapcore.ObjectMarshalerFunc(func(obj zapcore.ObjectEncoder) error {
+						obj.AddBool("a", true)
+						obj.OpenNamespace("inobj")
+						obj.AddBool("b", false)
+						return nil
+					})),
+					zap.Namespace("inner"),
+					zap.Int64("x", 1),
+				})
+
+				if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+					var v []interface{}
+
+					err = msgpack.Unmarshal(buf.Bytes(), &v)
+					if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+						assert.EqualValues(t, tt.expected, v[1], "Incorrect encoded msgpack entry")
+					}
+				}
+				buf.Free()
+			}
+
+			// original encoder is not affected by the clone
+			buf, err := enc.EncodeEntry(zapcore.Entry{}, []zapcore.Field{zap.Int64("code", 404)})
+			if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+				var v []interface{}
+
+				err = msgpack.Unmarshal(buf.Bytes(), &v)
+				if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+					assert.EqualValues(t, tt.original, v[1], "Incorrect encoded msgpack entry")
+				}
+			}
+			buf.Free()
+		})
+	}
+}
+
+func TestComplex(t *testing.T) {
+	fields := []zapcore.Field{
+		zap.Complex128("c128", complex(1.5, -2)),
+		zap.Complex64("c64", complex64(complex(0.5, 3))),
+		zap.Complex128s("c128s", []complex128{complex(0, 1)}),
+	}
+
+	t.Run("array", func(t *testing.T) {
+		enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{}, zapmsgpack.WithEpochTime())
+
+		buf, err := enc.EncodeEntry(zapcore.Entry{}, fields)
+		if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+			var v []interface{}
+
+			err = msgpack.Unmarshal(buf.Bytes(), &v)
+			if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+				assert.EqualValues(t, map[string]interface{}{
+					"c128":  []interface{}{1.5, -2.0},
+					"c64":   []interface{}{float32(0.5), float32(3)},
+					"c128s": []interface{}{[]interface{}{0.0, 1.0}},
+				}, v[1], "Incorrect encoded msgpack entry")
+			}
+		}
+		buf.Free()
+	})
+
+	t.Run("ext", func(t *testing.T) {
+		enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{}, zapmsgpack.WithEpochTime(), zapmsgpack.WithComplexExt(42))
+
+		buf, err := enc.EncodeEntry(zapcore.Entry{Time: time.Unix(1529426022, 0)}, fields[:2])
+		if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+			expected := []byte{0x92, 0xd3, 0, 0, 0, 0, 0x5b, 0x29, 0x30, 0x66, 0xdf, 0, 0, 0, 2}
+			expected = append(expected, 0xa4, 'c', '1', '2', '8', 0xd8, 42,
+				0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+				0xc0, 0x00, 0, 0, 0, 0, 0, 0)
+			expected = append(expected, 0xa3, 'c', '6', '4', 0xd7, 42,
+				0x3f, 0x00, 0, 0,
+				0x40, 0x40, 0, 0)
+
+			assert.Equal(t, expected, buf.Bytes())
+		}
+		buf.Free()
+	})
+}
+
+func TestFieldErrors(t *testing.T) {
+	type bad struct {
+		A string
+		B chan int
+	}
+
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{}, zapmsgpack.WithEpochTime())
+
+	buf, err := enc.EncodeEntry(zapcore.Entry{}, []zapcore.Field{
+		zap.String("before", "x"),
+		zap.Reflect("refl", bad{A: "a", B: make(chan int)}),
+		zap.Object("obj", zapcore.ObjectMarshalerFunc(func(obj zapcore.ObjectEncoder) error {
+			obj.AddString("a", "b")
+			return errors.New("obj failed")
+		})),
+		zap.Array("arr", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+			arr.AppendBool(true)
+			return arr.AppendReflected(bad{})
+		})),
+		zap.Array("arrok", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+			arr.AppendBool(true)
+			_ = arr.AppendObject(zapcore.ObjectMarshalerFunc(func(obj zapcore.ObjectEncoder) error {
+				obj.AddInt8("x", 1)
+				return errors.New("ignored error")
+			}))
+			return nil
+		})),
+		zap.String("after", "y"),
+	})
+
+	if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+		var v []interface{}
+
+		err = msgpack.Unmarshal(buf.Bytes(), &v)
+		if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+			record := v[1].(map[string]interface{})
+
+			assert.Contains(t, record["reflError"], "chan")
+			assert.Contains(t, record["arrError"], "chan")
+			delete(record, "reflError")
+			delete(record, "arrError")
+
+			assert.EqualValues(t, map[string]interface{}{
+				"before":   "x",
+				"objError": "obj failed",
+				"arrok":    []interface{}{true},
+				"after":    "y",
+			}, record, "Incorrect encoded msgpack entry")
+		}
+	}
+	buf.Free()
+}
+
+func TestCompactHeaders(t *testing.T) {
+	fields := []zapcore.Field{
+		zap.Object("o", zapcore.ObjectMarshalerFunc(func(obj zapcore.ObjectEncoder) error {
+			obj.AddInt8("a", 1)
+			return nil
+		})),
+		zap.Bools("arr", []bool{true}),
+		zap.Bools("big", make([]bool, 16)),
+		zap.Namespace("ns"),
+	}
+
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{}, zapmsgpack.WithEpochTime(), zapmsgpack.WithCompactHeaders())
+
+	buf, err := enc.EncodeEntry(zapcore.Entry{Time: time.Unix(1529426022, 0)}, fields)
+	if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+		expected := []byte{0x92, 0xd3, 0, 0, 0, 0, 0x5b, 0x29, 0x30, 0x66, 0x84}
+		expected = append(expected, 0xa1, 'o', 0x81, 0xa1, 'a', 0xd0, 0x01)
+		expected = append(expected, 0xa3, 'a', 'r', 'r', 0x91, 0xc3)
+		expected = append(expected, 0xa3, 'b', 'i', 'g', 0xdc, 0x00, 0x10)
+		expected = append(expected, bytes.Repeat([]byte{0xc2}, 16)...)
+		expected = append(expected, 0xa2, 'n', 's', 0x80)
+
+		assert.Equal(t, expected, buf.Bytes())
+	}
+	buf.Free()
+}
+
+type stringReflectedEncoder struct {
+	w io.Writer
+}
+
+func (e stringReflectedEncoder) Encode(v interface{}) error {
+	s, ok := v.(string)
+	if !ok {
+		return errors.New("not a string")
+	}
+
+	_, err := e.w.Write(append([]byte{0xa0 | byte(len(s))}, s...))
+
+	return err
+}
+
+func TestReflectedEncoder(t *testing.T) {
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{}, zapmsgpack.WithEpochTime(),
+		zapmsgpack.WithReflectedEncoder(func(w io.Writer) zapmsgpack.ReflectedEncoder {
+			return stringReflectedEncoder{w}
+		}))
+
+	buf, err := enc.EncodeEntry(zapcore.Entry{}, []zapcore.Field{
+		zap.Reflect("str", "foo"),
+		zap.Reflect("int", 42),
+	})
+
+	if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+		var v []interface{}
+
+		err = msgpack.Unmarshal(buf.Bytes(), &v)
+		if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+			assert.EqualValues(t, map[string]interface{}{
+				"str":      "foo",
+				"intError": "not a string",
+			}, v[1], "Incorrect encoded msgpack entry")
+		}
+	}
+	buf.Free()
+}
+
+func TestNamespacesAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not stable with race detector")
+	}
+
+	fields := []zapcore.Field{
+		zap.String("foo", "bar"),
+		zap.Namespace("inner"),
+		zap.Int64("x", 1),
+		zap.Object("obj", zapcore.ObjectMarshalerFunc(func(obj zapcore.ObjectEncoder) error {
+			obj.OpenNamespace("inobj")
+			obj.AddBool("b", false)
+			return nil
+		})),
+	}
+
+	for _, tt := range []struct {
+		desc string
+		opts []zapmsgpack.Option
+	}{
+		{
+			desc: "nested",
+		},
+		{
+			desc: "flat",
+			opts: []zapmsgpack.Option{zapmsgpack.WithFlatNamespaces()},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			enc := zapmsgpack.NewEncoder(testEncoderConfig(), tt.opts...)
+			enc.OpenNamespace("http")
+			enc.AddInt64("status", 200)
+
+			allocs := testing.AllocsPerRun(100, func() {
+				buf, _ := enc.EncodeEntry(zapcore.Entry{Message: "fake"}, fields)
+				buf.Free()
+			})
+
+			assert.Zero(t, allocs)
+		})
+	}
+}
+
+func TestMessageMode(t *testing.T) {
+	ent := zapcore.Entry{
+		Time:       time.Unix(1529426022, 0),
+		LoggerName: "db.pool",
+		Message:    "lob law",
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		tag      zapmsgpack.TagResolver
+		ent      zapcore.Entry
+		fields   []zapcore.Field
+		expected string
+	}{
+		{
+			desc:     "static",
+			tag:      zapmsgpack.StaticTag("app"),
+			ent:      ent,
+			expected: "app",
+		},
+		{
+			desc:     "logger name",
+			tag:      zapmsgpack.LoggerNameTag("app"),
+			ent:      ent,
+			expected: "db.pool",
+		},
+		{
+			desc:     "logger name fallback",
+			tag:      zapmsgpack.LoggerNameTag("app"),
+			ent:      zapcore.Entry{Time: ent.Time, Message: ent.Message},
+			expected: "app",
+		},
+		{
+			desc:     "field",
+			tag:      zapmsgpack.FieldTag("tag", "app"),
+			ent:      ent,
+			fields:   []zapcore.Field{zap.Int("tag", 3), zap.String("tag", "audit")},
+			expected: "audit",
+		},
+		{
+			desc:     "field fallback",
+			tag:      zapmsgpack.FieldTag("tag", "app"),
+			ent:      ent,
+			expected: "app",
+		},
+		{
+			desc:     "prefix",
+			tag:      zapmsgpack.PrefixTag("app.", zapmsgpack.LoggerNameTag("")),
+			ent:      ent,
+			expected: "app.db.pool",
+		},
+		{
+			desc:     "prefix unnamed",
+			tag:      zapmsgpack.PrefixTag("app.", zapmsgpack.LoggerNameTag("")),
+			ent:      zapcore.Entry{Time: ent.Time, Message: ent.Message},
+			expected: "app",
+		},
+		{
+			desc: "func",
+			tag: zapmsgpack.TagFunc(func(ent zapcore.Entry, fields []zapcore.Field) string {
+				return ent.Level.String() + "." + ent.LoggerName
+			}),
+			ent:      ent,
+			expected: "info.db.pool",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{MessageKey: "M"},
+				zapmsgpack.WithEpochTime(), zapmsgpack.WithMessageMode(tt.tag))
+
+			buf, err := enc.EncodeEntry(tt.ent, tt.fields)
+			if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+				var v []interface{}
+
+				err = msgpack.Unmarshal(buf.Bytes(), &v)
+				if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+					require.Len(t, v, 3)
+					assert.Equal(t, tt.expected, v[0])
+					assert.Equal(t, int64(1529426022), v[1])
+					assert.Equal(t, "lob law", v[2].(map[string]interface{})["M"])
+				}
+			}
+			buf.Free()
+		})
+	}
+}
+
+func TestMessageModeTagField(t *testing.T) {
+	ent := zapcore.Entry{
+		Time:    time.Unix(1529426022, 0),
+		Message: "lob law",
+	}
+
+	for _, tt := range []struct {
+		desc           string
+		flat           bool
+		context        []zapcore.Field
+		fields         []zapcore.Field
+		expectedTag    string
+		expectedRecord map[string]interface{}
+	}{
+		{
+			desc:           "no field",
+			fields:         []zapcore.Field{zap.Int("i", 1)},
+			expectedTag:    "app",
+			expectedRecord: map[string]interface{}{"M": "lob law", "i": int64(1)},
+		},
+		{
+			desc:           "entry field",
+			fields:         []zapcore.Field{zap.String("tag", "audit"), zap.Int("i", 1)},
+			expectedTag:    "app.audit",
+			expectedRecord: map[string]interface{}{"M": "lob law", "i": int64(1)},
+		},
+		{
+			desc:           "not a string",
+			fields:         []zapcore.Field{zap.Int("tag", 1)},
+			expectedTag:    "app",
+			expectedRecord: map[string]interface{}{"M": "lob law", "tag": int64(1)},
+		},
+		{
+			desc:           "context field",
+			context:        []zapcore.Field{zap.String("tag", "audit"), zap.Int("i", 1)},
+			expectedTag:    "app.audit",
+			expectedRecord: map[string]interface{}{"M": "lob law", "i": int64(1)},
+		},
+		{
+			desc:           "entry field overrides context",
+			context:        []zapcore.Field{zap.String("tag", "audit")},
+			fields:         []zapcore.Field{zap.String("tag", "security")},
+			expectedTag:    "app.security",
+			expectedRecord: map[string]interface{}{"M": "lob law"},
+		},
+		{
+			desc:        "namespace",
+			context:     []zapcore.Field{zap.Namespace("http"), zap.String("tag", "audit")},
+			fields:      []zapcore.Field{zap.String("tag", "security")},
+			expectedTag: "app",
+			expectedRecord: map[string]interface{}{
+				"M":    "lob law",
+				"http": map[string]interface{}{"tag": "security"},
+			},
+		},
+		{
+			desc:           "flat namespace",
+			flat:           true,
+			context:        []zapcore.Field{zap.Namespace("http"), zap.String("tag", "audit")},
+			expectedTag:    "app",
+			expectedRecord: map[string]interface{}{"M": "lob law", "http.tag": "audit"},
+		},
+		{
+			desc: "object",
+			fields: []zapcore.Field{zap.Object("obj", zapcore.ObjectMarshalerFunc(func(obj zapcore.ObjectEncoder) error {
+				obj.AddString("tag", "audit")
+				return nil
+			}))},
+			expectedTag: "app",
+			expectedRecord: map[string]interface{}{
+				"M":   "lob law",
+				"obj": map[string]interface{}{"tag": "audit"},
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			opts := []zapmsgpack.Option{
+				zapmsgpack.WithEpochTime(),
+				zapmsgpack.WithMessageMode(zapmsgpack.PrefixTag("app.", zapmsgpack.FieldTag("tag", ""))),
+			}
+			if tt.flat {
+				opts = append(opts, zapmsgpack.WithFlatNamespaces())
+			}
+
+			enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{MessageKey: "M"}, opts...)
+			for _, f := range tt.context {
+				f.AddTo(enc)
+			}
+
+			// context is kept intact
+			for i := 0; i < 2; i++ {
+				buf, err := enc.Clone().EncodeEntry(ent, tt.fields)
+				if assert.NoError(t, err, "Unexpected msgpack encoding error.") {
+					var v []interface{}
+
+					err = msgpack.Unmarshal(buf.Bytes(), &v)
+					if assert.NoErrorf(t, err, "Unexpected msgpack unmarshal error: %#v", buf.String()) {
+						require.Len(t, v, 3)
+						assert.Equal(t, tt.expectedTag, v[0])
+						assert.Equal(t, tt.expectedRecord, v[2])
+					}
+				}
+				buf.Free()
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoEndpoints is returned when the message can't be sent to any endpoint.
+var ErrNoEndpoints = errors.New("zapmsgpack: no endpoints available")
+
+// Endpoint is fluentd forward input messages are sent to.
+type Endpoint struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix", ClientConfig.Network by default.
+	Network string
+	// Address is host:port for TCP, socket path for unix domain socket.
+	Address string
+	// Weight is the relative share of messages sent to the endpoint, 1 by default.
+	Weight int
+	// Standby endpoint is used only when all the primary endpoints are unhealthy.
+	Standby bool
+}
+
+// BalanceMode is the policy of distributing messages between endpoints.
+type BalanceMode int
+
+// Balance modes.
+const (
+	// BalanceRoundRobin sends messages to the endpoints in turn, proportionally
+	// to their weights.
+	BalanceRoundRobin BalanceMode = iota
+	// BalanceLeastPending sends messages to the endpoint with the least number
+	// of messages in flight relative to its weight.
+	BalanceLeastPending
+)
+
+// endpoint is the Endpoint along with its connections.
+//
+// Endpoint is unhealthy when connection can't be established to it, or when
+// heartbeat fails.
+type endpoint struct {
+	Endpoint
+
+	pool      *connPool
+	heartbeat heartbeat
+
+	// balancer state
+	currentWeight int
+	pending       int
+}
+
+// balancer picks endpoints for the messages.
+type balancer struct {
+	mode      BalanceMode
+	endpoints []*endpoint
+
+	mu sync.Mutex
+}
+
+// pick returns the endpoint for the messages, excluded endpoints already failed
+// to deliver them.
+//
+// Healthy primary endpoints go first, then healthy standby endpoints. If there are
+// no healthy endpoints, unhealthy one is returned, so that the caller gets the
+// reason it's unhealthy.
+func (b *balancer) pick(excluded []*endpoint, n int) *endpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fallback *endpoint
+
+	for _, standby := range []bool{false, true} {
+		candidates := make([]*endpoint, 0, len(b.endpoints))
+
+		for _, ep := range b.endpoints {
+			if ep.Standby != standby || isExcluded(ep, excluded) {
+				continue
+			}
+
+			if !ep.healthy() {
+				if fallback == nil {
+					fallback = ep
+				}
+
+				continue
+			}
+
+			candidates = append(candidates, ep)
+		}
+
+		if ep := b.choose(candidates); ep != nil {
+			ep.pending += n
+
+			return ep
+		}
+	}
+
+	if fallback != nil {
+		fallback.pending += n
+	}
+
+	return fallback
+}
+
+// done is called when n messages picked for the endpoint are processed.
+func (b *balancer) done(ep *endpoint, n int) {
+	b.mu.Lock()
+	ep.pending -= n
+	b.mu.Unlock()
+}
+
+// choose picks one of the healthy endpoints.
+func (b *balancer) choose(candidates []*endpoint) *endpoint {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var chosen *endpoint
+
+	switch b.mode {
+	case BalanceLeastPending:
+		for _, ep := range candidates {
+			if chosen == nil || ep.pending*chosen.Weight < chosen.pending*ep.Weight {
+				chosen = ep
+			}
+		}
+	default:
+		// smooth weighted round-robin
+		total := 0
+
+		for _, ep := range candidates {
+			ep.currentWeight += ep.Weight
+			total += ep.Weight
+
+			if chosen == nil || ep.currentWeight > chosen.currentWeight {
+				chosen = ep
+			}
+		}
+
+		chosen.currentWeight -= total
+	}
+
+	return chosen
+}
+
+func (ep *endpoint) healthy() bool {
+	return ep.pool.healthy() && ep.heartbeat.healthy()
+}
+
+// alive is called when heartbeat succeeds, connection to unreachable endpoint
+// is retried immediately.
+//
+// Heartbeat doesn't prove messages could be delivered, so the backoff after
+// failed handshake or delivery is kept.
+func (ep *endpoint) alive() {
+	ep.heartbeat.seen()
+	ep.pool.reachable()
+}
+
+func isExcluded(ep *endpoint, excluded []*endpoint) bool {
+	for _, e := range excluded {
+		if e == ep {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+)
+
+// downAddress returns the address nobody listens on.
+func downAddress(t *testing.T) string {
+	server := newFakeServer(t, "127.0.0.1:0")
+	server.Close()
+
+	return server.Addr()
+}
+
+func messageCount(server *fakeServer) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return len(server.messages)
+}
+
+func TestClientRoundRobin(t *testing.T) {
+	server1 := newFakeServer(t, "127.0.0.1:0")
+	defer server1.Close()
+
+	server2 := newFakeServer(t, "127.0.0.1:0")
+	defer server2.Close()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Endpoints: []zapmsgpack.Endpoint{
+			{Address: server1.Addr(), Weight: 2},
+			{Address: server2.Addr()},
+		},
+		Tag: "app.test",
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	for _, entry := range encodeEntries(t, 6) {
+		_, err = client.Write(entry)
+		require.NoError(t, err)
+		require.NoError(t, client.Sync())
+	}
+
+	server1.waitMessages(t, 4)
+	server2.waitMessages(t, 2)
+}
+
+func TestClientFailover(t *testing.T) {
+	for _, balance := range []zapmsgpack.BalanceMode{zapmsgpack.BalanceRoundRobin, zapmsgpack.BalanceLeastPending} {
+		primary := newFakeServer(t, "127.0.0.1:0")
+		standby := newFakeServer(t, "127.0.0.1:0")
+
+		client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+			Endpoints: []zapmsgpack.Endpoint{
+				{Address: downAddress(t)},
+				{Address: primary.Addr()},
+				{Address: standby.Addr(), Standby: true},
+			},
+			Balance:    balance,
+			Tag:        "app.test",
+			MinBackoff: time.Minute,
+		})
+		require.NoError(t, err)
+
+		// failed endpoint is marked unhealthy, messages go to the healthy primary
+		for _, entry := range encodeEntries(t, 4) {
+			_, err = client.Write(entry)
+			require.NoError(t, err)
+			require.NoError(t, client.Sync())
+		}
+
+		primary.waitMessages(t, 4)
+		assert.Equal(t, 0, messageCount(standby))
+
+		// all primaries are down, standby is used
+		primary.Close()
+
+		for _, entry := range encodeEntries(t, 2) {
+			_, err = client.Write(entry)
+			require.NoError(t, err)
+			require.NoError(t, client.Sync())
+		}
+
+		standby.waitMessages(t, 2)
+
+		require.NoError(t, client.Close())
+		standby.Close()
+	}
+}
+
+func TestClientFailoverNoAck(t *testing.T) {
+	// endpoint accepts connections, but never acknowledges messages
+	stuck := newFakeServer(t, "127.0.0.1:0")
+	defer stuck.Close()
+
+	stuck.mu.Lock()
+	stuck.skipAcks = 1000
+	stuck.mu.Unlock()
+
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	const ackTimeout = 200 * time.Millisecond
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Endpoints: []zapmsgpack.Endpoint{
+			{Address: stuck.Addr()},
+			{Address: server.Addr()},
+		},
+		Tag:        "app.test",
+		RequireAck: true,
+		AckTimeout: ackTimeout,
+		MinBackoff: time.Minute,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	entries := encodeEntries(t, 3)
+
+	// first message times out on the stuck endpoint, and is sent to another one
+	_, err = client.Write(entries[0])
+	require.NoError(t, err)
+	require.NoError(t, client.Sync())
+
+	stuck.waitMessages(t, 1)
+	server.waitMessages(t, 1)
+
+	// stuck endpoint is unhealthy, so messages go to another endpoint right away
+	for _, entry := range entries[1:] {
+		_, err = client.Write(entry)
+		require.NoError(t, err)
+
+		start := time.Now()
+
+		require.NoError(t, client.Sync())
+		assert.True(t, time.Since(start) < ackTimeout)
+	}
+
+	server.waitMessages(t, 3)
+	assert.Equal(t, 1, messageCount(stuck))
+}
+
+func TestClientNoEndpoints(t *testing.T) {
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Endpoints: []zapmsgpack.Endpoint{
+			{Address: downAddress(t)},
+			{Address: downAddress(t), Standby: true},
+		},
+		Tag: "app.test",
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	_, err = client.Write(encodeEntries(t, 1)[0])
+	require.NoError(t, err)
+
+	assert.Error(t, client.Sync())
+	assert.Error(t, client.Sync())
+
+	_, err = zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:   "127.0.0.1:24224",
+		Endpoints: []zapmsgpack.Endpoint{{Address: "127.0.0.1:24224"}},
+	})
+	assert.Error(t, err)
+
+	_, err = zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Endpoints: []zapmsgpack.Endpoint{{Network: "udp", Address: "127.0.0.1:24224"}},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Errors returned by Batch.Append.
+var (
+	// ErrNotEntry is returned when appended bytes are neither "Entry" nor "Message" of forward protocol.
+	ErrNotEntry = errors.New("zapmsgpack: not a forward protocol entry")
+	// ErrTagMismatch is returned when the tag of appended "Message" doesn't match the tag of the batch.
+	ErrTagMismatch = errors.New("zapmsgpack: message tag doesn't match batch tag")
+)
+
+// MessageOptions is the option map of fluentd forward protocol messages.
+//
+// Number of entries ("size" option) is always sent.
+type MessageOptions struct {
+	// Chunk is the unique message id, server sends back an ack if it's set.
+	Chunk string
+}
+
+// BatchMode is the forward protocol mode used to serialize batches.
+type BatchMode int
+
+// Batch modes.
+const (
+	// ForwardMode sends entries as an array:
+	//
+	// [ tag, [ [ timestamp, record ], ... ], option ]
+	ForwardMode BatchMode = iota
+	// PackedForwardMode sends entries as a binary stream of concatenated entries:
+	//
+	// [ tag, bin([ timestamp, record ][ timestamp, record ]...), option ]
+	PackedForwardMode
+	// CompressedPackedForwardMode is PackedForwardMode with gzip-compressed
+	// binary stream, "compressed": "gzip" is added to the options.
+	CompressedPackedForwardMode
+)
+
+// Batch accumulates entries produced by msgpack encoder (EncodeEntry) and
+// serializes them as a single message of fluentd forward protocol.
+//
+// Serialization format depends on the Mode.
+//
+// See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1#forward-mode
+type Batch struct {
+	// Tag of all the entries in the batch.
+	Tag string
+	// Mode of forward protocol message.
+	Mode BatchMode
+	// Options sent along with the entries.
+	Options MessageOptions
+
+	entries    []byte
+	count      int
+	compressed bytes.Buffer
+	scratch    [32]byte
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// NewBatch creates empty batch for the tag.
+func NewBatch(tag string) *Batch {
+	return &Batch{
+		Tag: tag,
+	}
+}
+
+// Append copies an entry to the batch.
+//
+// Entry should be encoded by msgpack encoder, e.g. buffer returned by EncodeEntry.
+// Entries encoded in message mode (WithMessageMode) are accepted as well, if
+// their tag matches the tag of the batch, tag is stripped from the message.
+func (b *Batch) Append(entry []byte) error {
+	if len(entry) > 0 && entry[0] == fixArrayCode|3 {
+		tag, rest, err := splitMessage(entry)
+		if err != nil {
+			return err
+		}
+
+		if tag != b.Tag {
+			return ErrTagMismatch
+		}
+
+		b.entries = append(b.entries, fixArrayCode|2)
+		b.entries = append(b.entries, rest...)
+		b.count++
+
+		return nil
+	}
+
+	if len(entry) == 0 || entry[0] != fixArrayCode|2 {
+		return ErrNotEntry
+	}
+
+	b.entries = append(b.entries, entry...)
+	b.count++
+
+	return nil
+}
+
+// MessageTag returns the tag of forward protocol "Message" encoded in message
+// mode (WithMessageMode).
+//
+// It could be used to pick the batch to append the message to.
+func MessageTag(msg []byte) (string, error) {
+	tag, _, err := splitMessage(msg)
+
+	return tag, err
+}
+
+// splitMessage splits forward protocol message [ tag, timestamp, record ] into
+// the tag and the rest of the message (timestamp and record).
+func splitMessage(msg []byte) (string, []byte, error) {
+	if len(msg) < 2 || msg[0] != fixArrayCode|3 {
+		return "", nil, ErrNotEntry
+	}
+
+	msg = msg[1:]
+
+	var l, n int
+
+	switch {
+	case msg[0]&0xe0 == fixStrCode:
+		l, n = int(msg[0]&0x1f), 1
+	case msg[0] == str8Code && len(msg) >= 2:
+		l, n = int(msg[1]), 2
+	case msg[0] == str16Code && len(msg) >= 3:
+		l, n = int(binary.BigEndian.Uint16(msg[1:])), 3
+	case msg[0] == str32Code && len(msg) >= 5:
+		l, n = int(binary.BigEndian.Uint32(msg[1:])), 5
+	default:
+		return "", nil, ErrNotEntry
+	}
+
+	// tag should be followed by timestamp and record
+	if len(msg) <= n+l {
+		return "", nil, ErrNotEntry
+	}
+
+	return string(msg[n : n+l]), msg[n+l:], nil
+}
+
+// Len returns number of entries in the batch.
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Size returns total size of the entries in the batch.
+func (b *Batch) Size() int {
+	return len(b.entries)
+}
+
+// Reset removes all the entries and options from the batch, keeping the tag.
+func (b *Batch) Reset() {
+	b.entries = b.entries[:0]
+	b.count = 0
+	b.Options = MessageOptions{}
+}
+
+// payload returns entries as they should be sent in the message.
+func (b *Batch) payload() []byte {
+	if b.Mode != CompressedPackedForwardMode {
+		return b.entries
+	}
+
+	b.compressed.Reset()
+
+	zw := gzipPool.Get().(*gzip.Writer)
+	zw.Reset(&b.compressed)
+
+	// writes to bytes.Buffer never fail
+	_, _ = zw.Write(b.entries)
+	_ = zw.Close()
+
+	gzipPool.Put(zw)
+
+	return b.compressed.Bytes()
+}
+
+func (b *Batch) appendHeader(dst []byte, payload []byte) []byte {
+	dst = appendArrayHeader(dst, 3)
+	dst = appendString(dst, b.Tag)
+
+	if b.Mode == ForwardMode {
+		return appendArrayHeader(dst, b.count)
+	}
+
+	return appendBinHeader(dst, len(payload))
+}
+
+func (b *Batch) appendOptions(dst []byte) []byte {
+	size := 1
+	if b.Options.Chunk != "" {
+		size++
+	}
+
+	if b.Mode == CompressedPackedForwardMode {
+		size++
+	}
+
+	dst = appendMapHeader(dst, size)
+	dst = appendString(dst, "size")
+	dst = appendUint(dst, uint64(b.count))
+
+	if b.Options.Chunk != "" {
+		dst = appendString(dst, "chunk")
+		dst = appendString(dst, b.Options.Chunk)
+	}
+
+	if b.Mode == CompressedPackedForwardMode {
+		dst = appendString(dst, "compressed")
+		dst = appendString(dst, "gzip")
+	}
+
+	return dst
+}
+
+// AppendTo serializes the batch as forward protocol message appending it to dst.
+func (b *Batch) AppendTo(dst []byte) []byte {
+	payload := b.payload()
+
+	dst = b.appendHeader(dst, payload)
+	dst = append(dst, payload...)
+
+	return b.appendOptions(dst)
+}
+
+// WriteTo writes the batch as forward protocol message to w.
+//
+// Message is not assembled in memory, entries are written as is.
+func (b *Batch) WriteTo(w io.Writer) (int64, error) {
+	payload := b.payload()
+
+	header := b.appendHeader(b.scratch[:0], payload)
+	options := b.appendOptions(header[len(header):])
+
+	bufs := net.Buffers{header, payload, options}
+
+	return bufs.WriteTo(w)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+)
+
+func encodeEntries(t *testing.T, n int) [][]byte {
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{MessageKey: "M"}, zapmsgpack.WithEpochTime())
+
+	entries := make([][]byte, n)
+
+	for i := range entries {
+		buf, err := enc.EncodeEntry(zapcore.Entry{
+			Time:    time.Unix(1529426022+int64(i), 0),
+			Message: "lob law",
+		}, []zapcore.Field{zap.Int("i", i)})
+		require.NoError(t, err)
+
+		entries[i] = append([]byte(nil), buf.Bytes()...)
+		buf.Free()
+	}
+
+	return entries
+}
+
+func expectedEntries(n int) []interface{} {
+	entries := make([]interface{}, n)
+
+	for i := range entries {
+		entries[i] = []interface{}{
+			int64(1529426022 + i),
+			map[string]interface{}{
+				"M": "lob law",
+				"i": int64(i),
+			},
+		}
+	}
+
+	return entries
+}
+
+func TestBatch(t *testing.T) {
+	batch := zapmsgpack.NewBatch("app.test")
+
+	assert.Equal(t, zapmsgpack.ErrNotEntry, batch.Append([]byte{0x93, 0xa1, 'x'}))
+	assert.Equal(t, zapmsgpack.ErrNotEntry, batch.Append(nil))
+
+	for _, entry := range encodeEntries(t, 3) {
+		require.NoError(t, batch.Append(entry))
+	}
+
+	assert.Equal(t, 3, batch.Len())
+	assert.True(t, batch.Size() > 0)
+
+	batch.Options.Chunk = "Y2h1bmsK"
+
+	msg := batch.AppendTo(nil)
+
+	var v interface{}
+
+	require.NoError(t, msgpack.Unmarshal(msg, &v))
+	assert.EqualValues(t, []interface{}{
+		"app.test",
+		expectedEntries(3),
+		map[string]interface{}{
+			"size":  int8(3),
+			"chunk": "Y2h1bmsK",
+		},
+	}, v)
+
+	var buf bytes.Buffer
+
+	n, err := batch.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(msg), n)
+	assert.Equal(t, msg, buf.Bytes())
+
+	batch.Reset()
+
+	assert.Equal(t, 0, batch.Len())
+	assert.Equal(t, 0, batch.Size())
+
+	var empty interface{}
+
+	require.NoError(t, msgpack.Unmarshal(batch.AppendTo(nil), &empty))
+	assert.EqualValues(t, []interface{}{
+		"app.test",
+		[]interface{}{},
+		map[string]interface{}{
+			"size": int8(0),
+		},
+	}, empty)
+}
+
+func decodeEntryStream(stream []byte) []interface{} {
+	var entries []interface{}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(stream))
+
+	for {
+		entry, err := dec.DecodeInterface()
+		if err != nil {
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestPackedBatch(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		mode    zapmsgpack.BatchMode
+		options map[string]interface{}
+	}{
+		{
+			desc: "packed",
+			mode: zapmsgpack.PackedForwardMode,
+			options: map[string]interface{}{
+				"size": int8(3),
+			},
+		},
+		{
+			desc: "compressed",
+			mode: zapmsgpack.CompressedPackedForwardMode,
+			options: map[string]interface{}{
+				"size":       int8(3),
+				"compressed": "gzip",
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			batch := zapmsgpack.NewBatch("app.test")
+			batch.Mode = tt.mode
+
+			for _, entry := range encodeEntries(t, 3) {
+				require.NoError(t, batch.Append(entry))
+			}
+
+			msg := batch.AppendTo(nil)
+
+			var buf bytes.Buffer
+
+			_, err := batch.WriteTo(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, msg, buf.Bytes())
+
+			var v []interface{}
+
+			require.NoError(t, msgpack.Unmarshal(msg, &v))
+			require.Len(t, v, 3)
+
+			assert.Equal(t, "app.test", v[0])
+			assert.EqualValues(t, tt.options, v[2])
+
+			stream := v[1].([]byte)
+
+			if tt.mode == zapmsgpack.CompressedPackedForwardMode {
+				zr, err := gzip.NewReader(bytes.NewReader(stream))
+				require.NoError(t, err)
+
+				stream, err = ioutil.ReadAll(zr)
+				require.NoError(t, err)
+			}
+
+			assert.EqualValues(t, expectedEntries(3), decodeEntryStream(stream))
+		})
+	}
+}
+
+func TestBatchMessages(t *testing.T) {
+	enc := zapmsgpack.NewEncoder(zapcore.EncoderConfig{MessageKey: "M"},
+		zapmsgpack.WithEpochTime(), zapmsgpack.WithMessageMode(zapmsgpack.FieldTag("tag", "app.test")))
+
+	batch := zapmsgpack.NewBatch("app.test")
+
+	for i := 0; i < 3; i++ {
+		buf, err := enc.EncodeEntry(zapcore.Entry{
+			Time:    time.Unix(1529426022+int64(i), 0),
+			Message: "lob law",
+		}, []zapcore.Field{zap.Int("i", i)})
+		require.NoError(t, err)
+
+		tag, err := zapmsgpack.MessageTag(buf.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, "app.test", tag)
+
+		require.NoError(t, batch.Append(buf.Bytes()))
+		buf.Free()
+	}
+
+	buf, err := enc.EncodeEntry(zapcore.Entry{Message: "lob law"}, []zapcore.Field{zap.String("tag", "app.other")})
+	require.NoError(t, err)
+
+	tag, err := zapmsgpack.MessageTag(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, "app.other", tag)
+
+	assert.Equal(t, zapmsgpack.ErrTagMismatch, batch.Append(buf.Bytes()))
+	buf.Free()
+
+	_, err = zapmsgpack.MessageTag(encodeEntries(t, 1)[0])
+	assert.Equal(t, zapmsgpack.ErrNotEntry, err)
+
+	var v interface{}
+
+	require.NoError(t, msgpack.Unmarshal(batch.AppendTo(nil), &v))
+	assert.EqualValues(t, []interface{}{
+		"app.test",
+		expectedEntries(3),
+		map[string]interface{}{
+			"size": int8(3),
+		},
+	}, v)
+}
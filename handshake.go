@@ -0,0 +1,188 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Errors returned by the handshake.
+var (
+	// ErrHandshake is returned when fluentd doesn't follow the handshake protocol.
+	ErrHandshake = errors.New("zapmsgpack: unexpected handshake message")
+	// ErrServerDigest is returned when fluentd doesn't prove it knows shared key.
+	ErrServerDigest = errors.New("zapmsgpack: server shared key digest mismatch")
+)
+
+// AuthError is returned when fluentd rejects client credentials.
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return "zapmsgpack: authentication failed: " + e.Reason
+}
+
+// handshake is the client side of forward protocol handshake:
+//
+//	server: [ "HELO", { "nonce": nonce, "auth": salt, "keepalive": bool } ]
+//	client: [ "PING", hostname, shared_key_salt, shared_key_digest, username, password_digest ]
+//	server: [ "PONG", auth_result, reason, hostname, shared_key_digest ]
+//
+// See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1#handshake-messages
+type handshake struct {
+	sharedKey string
+	username  string
+	password  string
+	hostname  string
+}
+
+func (h *handshake) enabled() bool {
+	return h.sharedKey != ""
+}
+
+// run performs the handshake on the new connection.
+func (h *handshake) run(conn *conn, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	nonce, authSalt, keepalive, err := h.readHelo(conn)
+	if err != nil {
+		return err
+	}
+
+	conn.keepalive = keepalive
+
+	salt := newSalt()
+
+	ping := appendArrayHeader(nil, 6)
+	ping = appendString(ping, "PING")
+	ping = appendString(ping, h.hostname)
+	ping = appendString(ping, salt)
+	ping = appendString(ping, digest(salt, h.hostname, nonce, h.sharedKey))
+
+	if authSalt != "" {
+		ping = appendString(ping, h.username)
+		ping = appendString(ping, digest(authSalt, h.username, h.password))
+	} else {
+		ping = appendString(ping, "")
+		ping = appendString(ping, "")
+	}
+
+	if _, err = conn.Write(ping); err != nil {
+		return err
+	}
+
+	if err = h.readPong(conn, salt, nonce); err != nil {
+		return err
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+func (h *handshake) readHelo(conn *conn) (nonce, authSalt string, keepalive bool, err error) {
+	msg, err := conn.decoder().DecodeSlice()
+	if err != nil {
+		return
+	}
+
+	if len(msg) != 2 || msgString(msg[0]) != "HELO" {
+		err = ErrHandshake
+		return
+	}
+
+	options, ok := msg[1].(map[string]interface{})
+	if !ok {
+		err = ErrHandshake
+		return
+	}
+
+	nonce = msgString(options["nonce"])
+	authSalt = msgString(options["auth"])
+	keepalive = true
+
+	if v, ok := options["keepalive"].(bool); ok {
+		keepalive = v
+	}
+
+	return
+}
+
+func (h *handshake) readPong(conn *conn, salt, nonce string) error {
+	msg, err := conn.decoder().DecodeSlice()
+	if err != nil {
+		return err
+	}
+
+	if len(msg) != 5 || msgString(msg[0]) != "PONG" {
+		return ErrHandshake
+	}
+
+	if ok, _ := msg[1].(bool); !ok {
+		return &AuthError{Reason: msgString(msg[2])}
+	}
+
+	if msgString(msg[4]) != digest(salt, msgString(msg[3]), nonce, h.sharedKey) {
+		return ErrServerDigest
+	}
+
+	return nil
+}
+
+// msgString converts decoded msgpack str or bin to string.
+func msgString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+// digest returns hex-encoded SHA-512 digest of concatenated parts.
+func digest(parts ...string) string {
+	h := sha512.New()
+
+	for _, part := range parts {
+		_, _ = h.Write([]byte(part))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newSalt generates random hex-encoded salt.
+func newSalt() string {
+	var salt [16]byte
+
+	// crypto/rand never fails on supported platforms
+	_, _ = rand.Read(salt[:])
+
+	return hex.EncodeToString(salt[:])
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// HeartbeatType is the way Client checks health of the endpoints.
+type HeartbeatType int
+
+// Heartbeat types.
+const (
+	// HeartbeatNone disables heartbeat, endpoint is unhealthy only when
+	// connection to it fails.
+	HeartbeatNone HeartbeatType = iota
+	// HeartbeatTCP establishes new connection to the endpoint.
+	HeartbeatTCP
+	// HeartbeatUDP sends UDP packet to the endpoint port, fluentd forward
+	// input responds to it. Unix domain socket endpoints are checked with
+	// HeartbeatTCP.
+	HeartbeatUDP
+)
+
+// EndpointHealth is the health state of the endpoint.
+type EndpointHealth struct {
+	Endpoint
+
+	// Healthy is true if messages could be sent to the endpoint.
+	Healthy bool
+	// LastHeartbeat is the time of the last successful heartbeat.
+	LastHeartbeat time.Time
+	// Err is the reason endpoint is unhealthy.
+	Err error
+}
+
+// heartbeat tracks results of the heartbeats, endpoint is unhealthy if there
+// was no successful heartbeat within the timeout.
+type heartbeat struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	enabled  bool
+	lastSeen time.Time
+	err      error
+}
+
+func (h *heartbeat) seen() {
+	h.mu.Lock()
+	h.lastSeen = time.Now()
+	h.err = nil
+	h.mu.Unlock()
+}
+
+func (h *heartbeat) failed(err error) {
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+}
+
+func (h *heartbeat) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return !h.enabled || time.Since(h.lastSeen) <= h.timeout
+}
+
+// runHeartbeat checks health of the endpoint until the client is closed.
+func (c *Client) runHeartbeat(ep *endpoint) {
+	defer c.wg.Done()
+
+	var udp net.Conn
+
+	if c.cfg.Heartbeat == HeartbeatUDP && ep.Network != "unix" {
+		var err error
+
+		// fluentd forward input listens for UDP heartbeats on the same port
+		if udp, err = net.Dial("udp", ep.Address); err != nil {
+			ep.heartbeat.failed(err)
+		} else {
+			defer udp.Close()
+
+			c.wg.Add(1)
+
+			go c.readHeartbeats(ep, udp)
+		}
+	}
+
+	ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if udp != nil {
+			if _, err := udp.Write([]byte{0}); err != nil {
+				ep.heartbeat.failed(err)
+			}
+		} else {
+			c.probeTCP(ep)
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeTCP establishes and closes connection to the endpoint.
+func (c *Client) probeTCP(ep *endpoint) {
+	conn, err := net.DialTimeout(ep.Network, ep.Address, c.cfg.DialTimeout)
+	if err != nil {
+		ep.heartbeat.failed(err)
+		return
+	}
+
+	_ = conn.Close()
+
+	ep.alive()
+}
+
+// readHeartbeats reads responses to UDP heartbeats.
+func (c *Client) readHeartbeats(ep *endpoint, udp net.Conn) {
+	defer c.wg.Done()
+
+	var buf [16]byte
+
+	for {
+		_, err := udp.Read(buf[:])
+
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			// e.g. port is unreachable
+			ep.heartbeat.failed(err)
+
+			// avoid busy loop if socket is broken
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(c.cfg.HeartbeatInterval):
+			}
+
+			continue
+		}
+
+		ep.alive()
+	}
+}
+
+// Health returns health state of the endpoints.
+func (c *Client) Health() []EndpointHealth {
+	health := make([]EndpointHealth, 0, len(c.balancer.endpoints))
+
+	for _, ep := range c.balancer.endpoints {
+		h := EndpointHealth{
+			Endpoint: ep.Endpoint,
+			Healthy:  ep.healthy(),
+		}
+
+		ep.heartbeat.mu.Lock()
+		h.LastHeartbeat, h.Err = ep.heartbeat.lastSeen, ep.heartbeat.err
+		ep.heartbeat.mu.Unlock()
+
+		if h.Err == nil {
+			h.Err = ep.pool.lastError()
+		}
+
+		health = append(health, h)
+	}
+
+	return health
+}
+
+// Healthy returns true if there's at least one healthy endpoint.
+func (c *Client) Healthy() bool {
+	for _, ep := range c.balancer.endpoints {
+		if ep.healthy() {
+			return true
+		}
+	}
+
+	return false
+}
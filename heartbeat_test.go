@@ -0,0 +1,238 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+)
+
+// waitHealth waits for the health state of the endpoints.
+func waitHealth(t *testing.T, client *zapmsgpack.Client, expected ...bool) []zapmsgpack.EndpointHealth {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		health := client.Health()
+
+		actual := make([]bool, len(health))
+		for i := range health {
+			actual[i] = health[i].Healthy
+		}
+
+		if assert.ObjectsAreEqual(expected, actual) || time.Now().After(deadline) {
+			require.Equal(t, expected, actual)
+
+			return health
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHeartbeatTCP(t *testing.T) {
+	primary := newFakeServer(t, "127.0.0.1:0")
+	address := primary.Addr()
+
+	standby := newFakeServer(t, "127.0.0.1:0")
+	defer standby.Close()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Endpoints: []zapmsgpack.Endpoint{
+			{Address: address},
+			{Address: standby.Addr(), Standby: true},
+		},
+		Tag:               "app.test",
+		Heartbeat:         zapmsgpack.HeartbeatTCP,
+		HeartbeatInterval: 10 * time.Millisecond,
+		MinBackoff:        time.Minute,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	health := waitHealth(t, client, true, true)
+	assert.Equal(t, address, health[0].Address)
+	assert.False(t, health[0].LastHeartbeat.IsZero())
+	assert.True(t, client.Healthy())
+
+	// dead primary is detected without sending anything to it
+	primary.Close()
+
+	health = waitHealth(t, client, false, true)
+	assert.Error(t, health[0].Err)
+
+	_, err = client.Write(encodeEntries(t, 1)[0])
+	require.NoError(t, err)
+	require.NoError(t, client.Sync())
+
+	standby.waitMessages(t, 1)
+
+	// primary recovers
+	primary = newFakeServer(t, address)
+	defer primary.Close()
+
+	waitHealth(t, client, true, true)
+
+	_, err = client.Write(encodeEntries(t, 1)[0])
+	require.NoError(t, err)
+	require.NoError(t, client.Sync())
+
+	primary.waitMessages(t, 1)
+
+	standby.Close()
+	primary.Close()
+
+	waitHealth(t, client, false, false)
+	assert.False(t, client.Healthy())
+}
+
+func TestHeartbeatHandshakeFailure(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	server.mu.Lock()
+	server.sharedKey = "secret"
+	server.mu.Unlock()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:           server.Addr(),
+		Tag:               "app.test",
+		SharedKey:         "wrong",
+		Heartbeat:         zapmsgpack.HeartbeatTCP,
+		HeartbeatInterval: 10 * time.Millisecond,
+		MinBackoff:        time.Minute,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	_, err = client.Write(encodeEntries(t, 1)[0])
+	require.NoError(t, err)
+	assert.Error(t, client.Sync())
+
+	// endpoint accepts connections, but it stays unhealthy
+	time.Sleep(50 * time.Millisecond)
+
+	health := waitHealth(t, client, false)
+	assert.Equal(t, &zapmsgpack.AuthError{Reason: "shared key mismatch"}, health[0].Err)
+	assert.False(t, client.Healthy())
+}
+
+func TestHeartbeatConcurrentClose(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:           server.Addr(),
+		Tag:               "app.test",
+		Heartbeat:         zapmsgpack.HeartbeatUDP,
+		HeartbeatInterval: time.Minute,
+	})
+	require.NoError(t, err)
+
+	_, err = client.Write(encodeEntries(t, 1)[0])
+	require.NoError(t, err)
+
+	const n = 4
+
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- client.Close()
+		}()
+	}
+
+	closed := 0
+
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			if err == zapmsgpack.ErrClientClosed {
+				closed++
+			} else {
+				assert.NoError(t, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("close is blocked")
+		}
+	}
+
+	assert.Equal(t, n-1, closed)
+
+	server.waitMessages(t, 1)
+}
+
+// fakeHeartbeatResponder responds to UDP heartbeats like fluentd forward input.
+func fakeHeartbeatResponder(t *testing.T, address string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", address)
+	require.NoError(t, err)
+
+	go func() {
+		var buf [16]byte
+
+		for {
+			_, addr, err := conn.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.WriteTo([]byte{0}, addr)
+		}
+	}()
+
+	return conn
+}
+
+func TestHeartbeatUDP(t *testing.T) {
+	server := newFakeServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	responder := fakeHeartbeatResponder(t, server.Addr())
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:           server.Addr(),
+		Tag:               "app.test",
+		Heartbeat:         zapmsgpack.HeartbeatUDP,
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	waitHealth(t, client, true)
+
+	responder.Close()
+
+	waitHealth(t, client, false)
+
+	responder = fakeHeartbeatResponder(t, server.Addr())
+	defer responder.Close()
+
+	waitHealth(t, client, true)
+}
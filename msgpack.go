@@ -0,0 +1,290 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"math"
+	"time"
+)
+
+// Append-style msgpack primitives.
+//
+// Sized integer types preserve their type (e.g. int16 is always encoded as int 16),
+// while int and uint use the shortest encoding.
+//
+// See https://github.com/msgpack/msgpack/blob/master/spec.md
+
+const (
+	nilCode      = 0xc0
+	falseCode    = 0xc2
+	trueCode     = 0xc3
+	bin8Code     = 0xc4
+	bin16Code    = 0xc5
+	bin32Code    = 0xc6
+	ext8Code     = 0xc7
+	ext16Code    = 0xc8
+	ext32Code    = 0xc9
+	float32Code  = 0xca
+	float64Code  = 0xcb
+	uint8Code    = 0xcc
+	uint16Code   = 0xcd
+	uint32Code   = 0xce
+	uint64Code   = 0xcf
+	int8Code     = 0xd0
+	int16Code    = 0xd1
+	int32Code    = 0xd2
+	int64Code    = 0xd3
+	fixExt1Code  = 0xd4
+	fixExt2Code  = 0xd5
+	fixExt4Code  = 0xd6
+	fixExt8Code  = 0xd7
+	fixExt16Code = 0xd8
+	fixStrCode   = 0xa0
+	str8Code     = 0xd9
+	str16Code    = 0xda
+	str32Code    = 0xdb
+	fixArrayCode = 0x90
+	array16Code  = 0xdc
+	array32Code  = 0xdd
+	fixMapCode   = 0x80
+	map16Code    = 0xde
+	map32Code    = 0xdf
+)
+
+// timestampExt is the msgpack extension type of timestamp.
+const timestampExt = -1
+
+func appendBigEndian32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendBigEndian64(b []byte, n uint64) []byte {
+	return append(b, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+		byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func append1(b []byte, code byte, n uint8) []byte {
+	return append(b, code, n)
+}
+
+func append2(b []byte, code byte, n uint16) []byte {
+	return append(b, code, byte(n>>8), byte(n))
+}
+
+func append4(b []byte, code byte, n uint32) []byte {
+	return appendBigEndian32(append(b, code), n)
+}
+
+func append8(b []byte, code byte, n uint64) []byte {
+	return appendBigEndian64(append(b, code), n)
+}
+
+func appendNil(b []byte) []byte {
+	return append(b, nilCode)
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, trueCode)
+	}
+
+	return append(b, falseCode)
+}
+
+func appendUint(b []byte, n uint64) []byte {
+	switch {
+	case n <= math.MaxInt8:
+		return append(b, byte(n))
+	case n <= math.MaxUint8:
+		return append1(b, uint8Code, uint8(n))
+	case n <= math.MaxUint16:
+		return append2(b, uint16Code, uint16(n))
+	case n <= math.MaxUint32:
+		return append4(b, uint32Code, uint32(n))
+	default:
+		return append8(b, uint64Code, n)
+	}
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8:
+		return append1(b, int8Code, uint8(n))
+	case n >= math.MinInt16:
+		return append2(b, int16Code, uint16(n))
+	case n >= math.MinInt32:
+		return append4(b, int32Code, uint32(n))
+	default:
+		return append8(b, int64Code, uint64(n))
+	}
+}
+
+func appendUint8(b []byte, n uint8) []byte {
+	return append1(b, uint8Code, n)
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append2(b, uint16Code, n)
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append4(b, uint32Code, n)
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	return append8(b, uint64Code, n)
+}
+
+func appendInt8(b []byte, n int8) []byte {
+	return append1(b, int8Code, uint8(n))
+}
+
+func appendInt16(b []byte, n int16) []byte {
+	return append2(b, int16Code, uint16(n))
+}
+
+func appendInt32(b []byte, n int32) []byte {
+	return append4(b, int32Code, uint32(n))
+}
+
+func appendInt64(b []byte, n int64) []byte {
+	return append8(b, int64Code, uint64(n))
+}
+
+func appendFloat32(b []byte, f float32) []byte {
+	return append4(b, float32Code, math.Float32bits(f))
+}
+
+func appendFloat64(b []byte, f float64) []byte {
+	return append8(b, float64Code, math.Float64bits(f))
+}
+
+func appendStrHeader(b []byte, l int) []byte {
+	switch {
+	case l < 32:
+		return append(b, fixStrCode|byte(l))
+	case l <= math.MaxUint8:
+		return append1(b, str8Code, uint8(l))
+	case l <= math.MaxUint16:
+		return append2(b, str16Code, uint16(l))
+	default:
+		return append4(b, str32Code, uint32(l))
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendStrHeader(b, len(s)), s...)
+}
+
+func appendBinHeader(b []byte, l int) []byte {
+	switch {
+	case l <= math.MaxUint8:
+		return append1(b, bin8Code, uint8(l))
+	case l <= math.MaxUint16:
+		return append2(b, bin16Code, uint16(l))
+	default:
+		return append4(b, bin32Code, uint32(l))
+	}
+}
+
+func appendArrayHeader(b []byte, l int) []byte {
+	switch {
+	case l < 16:
+		return append(b, fixArrayCode|byte(l))
+	case l <= math.MaxUint16:
+		return append2(b, array16Code, uint16(l))
+	default:
+		return append4(b, array32Code, uint32(l))
+	}
+}
+
+func appendMapHeader(b []byte, l int) []byte {
+	switch {
+	case l < 16:
+		return append(b, fixMapCode|byte(l))
+	case l <= math.MaxUint16:
+		return append2(b, map16Code, uint16(l))
+	default:
+		return append4(b, map32Code, uint32(l))
+	}
+}
+
+func appendExtHeader(b []byte, typ int8, l int) []byte {
+	switch l {
+	case 1:
+		b = append(b, fixExt1Code)
+	case 2:
+		b = append(b, fixExt2Code)
+	case 4:
+		b = append(b, fixExt4Code)
+	case 8:
+		b = append(b, fixExt8Code)
+	case 16:
+		b = append(b, fixExt16Code)
+	default:
+		switch {
+		case l <= math.MaxUint8:
+			b = append1(b, ext8Code, uint8(l))
+		case l <= math.MaxUint16:
+			b = append2(b, ext16Code, uint16(l))
+		default:
+			b = append4(b, ext32Code, uint32(l))
+		}
+	}
+
+	return append(b, byte(typ))
+}
+
+// appendTimestamp encodes time as msgpack timestamp extension in the shortest
+// of 32-bit, 64-bit and 96-bit formats.
+func appendTimestamp(b []byte, t time.Time) []byte {
+	secs := uint64(t.Unix())
+
+	if secs>>34 == 0 {
+		data := uint64(t.Nanosecond())<<34 | secs
+
+		if data&0xffffffff00000000 == 0 {
+			b = appendExtHeader(b, timestampExt, 4)
+			return appendBigEndian32(b, uint32(data))
+		}
+
+		b = appendExtHeader(b, timestampExt, 8)
+
+		return appendBigEndian64(b, data)
+	}
+
+	b = appendExtHeader(b, timestampExt, 12)
+	b = appendBigEndian32(b, uint32(t.Nanosecond()))
+
+	return appendBigEndian64(b, secs)
+}
+
+// appendEventTime encodes time as fluentd EventTime extension.
+func appendEventTime(b []byte, t time.Time) []byte {
+	b = appendExtHeader(b, eventTimeExt, 8)
+	b = appendBigEndian32(b, uint32(t.Unix()))
+
+	return appendBigEndian32(b, uint32(t.Nanosecond()))
+}
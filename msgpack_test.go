@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestPrimitives(t *testing.T) {
+	ints := []int64{0, 1, 127, 128, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, math.MaxInt64,
+		-1, -32, -33, -128, -129, -32768, -32769, math.MinInt32, math.MinInt32 - 1, math.MinInt64}
+	lengths := []int{0, 1, 15, 16, 31, 32, 255, 256, 65535, 65536}
+
+	var ref bytes.Buffer
+
+	refEnc := msgpack.NewEncoder(&ref)
+
+	check := func(name string, actual []byte, encode func() error) {
+		ref.Reset()
+		assert.NoError(t, encode())
+		assert.Equal(t, ref.Bytes(), actual, name)
+	}
+
+	for _, n := range ints {
+		n := n
+
+		check("int", appendInt(nil, n), func() error { return refEnc.EncodeInt(n) })
+		check("int64", appendInt64(nil, n), func() error { return refEnc.EncodeInt64(n) })
+		check("int32", appendInt32(nil, int32(n)), func() error { return refEnc.EncodeInt32(int32(n)) })
+		check("int16", appendInt16(nil, int16(n)), func() error { return refEnc.EncodeInt16(int16(n)) })
+		check("int8", appendInt8(nil, int8(n)), func() error { return refEnc.EncodeInt8(int8(n)) })
+		check("uint", appendUint(nil, uint64(n)), func() error { return refEnc.EncodeUint(uint64(n)) })
+		check("uint64", appendUint64(nil, uint64(n)), func() error { return refEnc.EncodeUint64(uint64(n)) })
+		check("uint32", appendUint32(nil, uint32(n)), func() error { return refEnc.EncodeUint32(uint32(n)) })
+		check("uint16", appendUint16(nil, uint16(n)), func() error { return refEnc.EncodeUint16(uint16(n)) })
+		check("uint8", appendUint8(nil, uint8(n)), func() error { return refEnc.EncodeUint8(uint8(n)) })
+		check("float32", appendFloat32(nil, float32(n)), func() error { return refEnc.EncodeFloat32(float32(n)) })
+		check("float64", appendFloat64(nil, float64(n)), func() error { return refEnc.EncodeFloat64(float64(n)) })
+	}
+
+	for _, l := range lengths {
+		l := l
+		s := strings.Repeat("x", l)
+
+		check("string", appendString(nil, s), func() error { return refEnc.EncodeString(s) })
+		check("bin", appendBinHeader(nil, l), func() error { return refEnc.EncodeBytesLen(l) })
+		check("array", appendArrayHeader(nil, l), func() error { return refEnc.EncodeArrayLen(l) })
+		check("map", appendMapHeader(nil, l), func() error { return refEnc.EncodeMapLen(l) })
+	}
+
+	check("nil", appendNil(nil), refEnc.EncodeNil)
+	check("true", appendBool(nil, true), func() error { return refEnc.EncodeBool(true) })
+	check("false", appendBool(nil, false), func() error { return refEnc.EncodeBool(false) })
+
+	for _, ts := range []time.Time{
+		time.Unix(1529426022, 0),
+		time.Unix(1529426022, 99),
+		time.Unix(1<<35, 99),
+	} {
+		ts := ts
+
+		check("timestamp", appendTimestamp(nil, ts), func() error { return refEnc.EncodeTime(ts) })
+	}
+}
+
+func TestExtHeader(t *testing.T) {
+	for _, tt := range []struct {
+		l        int
+		expected []byte
+	}{
+		{1, []byte{0xd4, 0x05}},
+		{2, []byte{0xd5, 0x05}},
+		{4, []byte{0xd6, 0x05}},
+		{8, []byte{0xd7, 0x05}},
+		{16, []byte{0xd8, 0x05}},
+		{3, []byte{0xc7, 0x03, 0x05}},
+		{256, []byte{0xc8, 0x01, 0x00, 0x05}},
+		{65536, []byte{0xc9, 0x00, 0x01, 0x00, 0x00, 0x05}},
+	} {
+		assert.Equal(t, tt.expected, appendExtHeader(nil, 5, tt.l))
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// Option configures msgpack encoder.
+type Option func(*options)
+
+type options struct {
+	entryTimeEncoder zapcore.TimeEncoder
+	flatNamespaces   bool
+	complexExt       bool
+	complexExtType   int8
+	compactHeaders   bool
+	messageTag       TagResolver
+	messageTagKey    string
+
+	newReflectedEncoder NewReflectedEncoderFunc
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		newReflectedEncoder: DefaultReflectedEncoder,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithEntryTimeEncoder sets the encoder for the timestamp of forward protocol
+// Entry (first element of the [ timestamp, record ] pair).
+//
+// By default entry timestamp is encoded as msgpack timestamp extension,
+// EncoderConfig.EncodeTime is not used for it.
+func WithEntryTimeEncoder(timeEncoder zapcore.TimeEncoder) Option {
+	return func(o *options) {
+		o.entryTimeEncoder = timeEncoder
+	}
+}
+
+// WithEventTime encodes entry timestamp as fluentd EventTime extension
+// preserving nanosecond precision.
+func WithEventTime() Option {
+	return WithEntryTimeEncoder(EventTimeEncoder)
+}
+
+// WithEpochTime encodes entry timestamp as integer number of seconds
+// since the Unix epoch.
+func WithEpochTime() Option {
+	return WithEntryTimeEncoder(EpochSecondsTimeEncoder)
+}
+
+// WithFlatNamespaces encodes namespaces as key prefixes joined with dots
+// instead of nested maps.
+//
+// E.g. zap.Namespace("http") followed by zap.Int("status", 200) produces
+// {"http.status": 200} instead of {"http": {"status": 200}}, which is handy
+// for pipelines which flatten records anyway.
+func WithFlatNamespaces() Option {
+	return func(o *options) {
+		o.flatNamespaces = true
+	}
+}
+
+// WithComplexExt encodes complex numbers as msgpack extension of the given type.
+//
+// Extension payload is real and imaginary parts as big-endian IEEE 754 numbers:
+// 16 bytes (two float64) for complex128 and 8 bytes (two float32) for complex64.
+//
+// By default complex numbers are encoded as [real, imag] array of floats.
+func WithComplexExt(extType int8) Option {
+	return func(o *options) {
+		o.complexExt = true
+		o.complexExtType = extType
+	}
+}
+
+// WithCompactHeaders encodes arrays and maps with the shortest possible headers.
+//
+// Sizes of maps and arrays are not known until they are fully encoded, so by default
+// fixed-width 32-bit headers are reserved and patched afterwards. This is valid msgpack,
+// but it takes up to 4 extra bytes per container. With this option encoder moves
+// contents of every container back to fit in the shortest header, which costs
+// extra copying.
+func WithCompactHeaders() Option {
+	return func(o *options) {
+		o.compactHeaders = true
+	}
+}
+
+// WithReflectedEncoder sets the encoder for arbitrary objects (zap.Reflect and AddReflected).
+//
+// By default DefaultReflectedEncoder is used.
+func WithReflectedEncoder(newReflectedEncoder NewReflectedEncoderFunc) Option {
+	return func(o *options) {
+		o.newReflectedEncoder = newReflectedEncoder
+	}
+}
+
+// WithMessageMode encodes entries as forward protocol "Message" with the tag
+// resolved for every entry:
+//
+// [ tag, timestamp, { key : value, ... } ]
+//
+// Messages could be sent to fluentd one by one without batching, or
+// appended to the Batch of the same tag.
+//
+// If the tag is taken from the field (FieldTag), the field is not encoded
+// in the record.
+func WithMessageMode(tag TagResolver) Option {
+	return func(o *options) {
+		o.messageTag = tag
+		o.messageTagKey = tagKey(tag)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"io"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// ReflectedEncoder serializes arbitrary objects passed to zap.Reflect.
+//
+// Output should be a single msgpack value.
+type ReflectedEncoder interface {
+	Encode(interface{}) error
+}
+
+// NewReflectedEncoderFunc creates ReflectedEncoder writing to w.
+type NewReflectedEncoderFunc func(w io.Writer) ReflectedEncoder
+
+// DefaultReflectedEncoder uses github.com/vmihailenco/msgpack to encode objects.
+func DefaultReflectedEncoder(w io.Writer) ReflectedEncoder {
+	return msgpack.NewEncoder(w)
+}
+
+// bufWriter directs ReflectedEncoder output to the current buffer of the encoder.
+//
+// It implements io.ByteWriter and io.StringWriter, so that msgpack.Encoder
+// doesn't wrap it.
+type bufWriter struct {
+	enc *encoder
+}
+
+func (w bufWriter) Write(p []byte) (int, error) {
+	return w.enc.buf.Write(p)
+}
+
+func (w bufWriter) WriteByte(c byte) error {
+	w.enc.buf.AppendByte(c)
+	return nil
+}
+
+func (w bufWriter) WriteString(s string) (int, error) {
+	w.enc.buf.AppendString(s)
+	return len(s), nil
+}
+
+func (enc *encoder) encodeReflected(val interface{}) error {
+	return enc.opts.newReflectedEncoder(bufWriter{enc}).Encode(val)
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package register registers msgpack encoder with zap, so that it could
+// be used with zap.Config:
+//
+//	import _ "github.com/smira/zap-msgpack-encoder/register"
+//
+// Encoder is registered as "msgpack" (default options) and "fluentd" (entry
+// timestamp is encoded as fluentd EventTime).
+package register
+
+import (
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+)
+
+func init() {
+	if err := zapmsgpack.RegisterEncoder(zapmsgpack.EncoderName); err != nil {
+		panic(err)
+	}
+
+	if err := zapmsgpack.RegisterEncoder(zapmsgpack.FluentdEncoderName, zapmsgpack.WithEventTime()); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errCorruptedSegment = errors.New("zapmsgpack: corrupted spool segment")
+
+// spool keeps forward protocol messages pending delivery on disk.
+//
+// Every message is stored in a separate segment file named after the sequence
+// number, so messages are replayed in order. Sequence numbers are reserved when
+// messages are sealed, so segments might be written out of order. Segment file is the chunk id
+// (uvarint length followed by the chunk) and the message itself.
+//
+// Segments are written to the temporary file first, and renamed once synced,
+// so partially written segments are never replayed.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	segments []spoolSegment
+	size     int64
+	nextSeq  uint64
+}
+
+// spoolSegment is a segment file, oldest segments go first.
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+const (
+	spoolExt    = ".seg"
+	spoolTmpExt = ".tmp"
+	// segments which can't be read are renamed, so they could be inspected
+	spoolBadExt = ".bad"
+	// maximum size of the segment header
+	spoolMaxHeader = binary.MaxVarintLen64 + 256
+)
+
+// openSpool opens the spool directory, messages left from the previous run
+// are returned in order.
+func openSpool(dir string, maxBytes int64) (*spool, []message, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		nextSeq:  1,
+	}
+
+	for _, file := range files {
+		name := file.Name()
+
+		if strings.HasSuffix(name, spoolTmpExt) {
+			// segment was not completely written
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: file.Size()})
+		s.size += file.Size()
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if len(s.segments) > 0 {
+		s.nextSeq = s.segments[len(s.segments)-1].seq + 1
+	}
+
+	messages := make([]message, 0, len(s.segments))
+
+	// corrupted segments are removed while iterating
+	for _, segment := range append([]spoolSegment(nil), s.segments...) {
+		chunk, err := s.readChunk(segment.seq)
+		if err == errCorruptedSegment {
+			s.remove(segment.seq)
+			continue
+		}
+
+		if err != nil {
+			s.quarantine(segment.seq)
+			continue
+		}
+
+		messages = append(messages, message{
+			chunk: chunk,
+			seq:   segment.seq,
+		})
+	}
+
+	return s, messages, nil
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// reserve returns the sequence number of the next segment.
+func (s *spool) reserve() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.nextSeq
+	s.nextSeq++
+
+	return seq
+}
+
+// push writes the message to the segment with the sequence number reserved
+// in msg.seq.
+//
+// Oldest segments are evicted to keep spool within the size limit, sequence
+// numbers of evicted segments are returned (it might include the new segment).
+func (s *spool) push(msg *message) ([]uint64, error) {
+	seq := msg.seq
+
+	header := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(msg.chunk))
+	header = append(header[:binary.PutUvarint(header, uint64(len(msg.chunk)))], msg.chunk...)
+	size := int64(len(header) + len(msg.data))
+
+	path := s.path(seq)
+
+	if err := writeFileSync(path+spoolTmpExt, header, msg.data); err != nil {
+		_ = os.Remove(path + spoolTmpExt)
+
+		return nil, err
+	}
+
+	if err := os.Rename(path+spoolTmpExt, path); err != nil {
+		_ = os.Remove(path + spoolTmpExt)
+
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// segments written concurrently are kept in order of sequence numbers
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].seq > seq })
+
+	s.segments = append(s.segments, spoolSegment{})
+	copy(s.segments[i+1:], s.segments[i:])
+	s.segments[i] = spoolSegment{seq: seq, size: size}
+	s.size += size
+
+	var evicted []uint64
+
+	for s.size > s.maxBytes && len(s.segments) > 0 {
+		segment := s.segments[0]
+		s.segments = s.segments[1:]
+		s.size -= segment.size
+
+		_ = os.Remove(s.path(segment.seq))
+
+		evicted = append(evicted, segment.seq)
+	}
+
+	return evicted, nil
+}
+
+// read returns the message stored in the segment.
+//
+// If segment was evicted, error satisfies os.IsNotExist.
+func (s *spool) read(seq uint64) ([]byte, error) {
+	contents, err := ioutil.ReadFile(s.path(seq))
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := parseSegment(contents)
+
+	return data, err
+}
+
+// readChunk returns the chunk id of the message stored in the segment.
+func (s *spool) readChunk(seq uint64) (string, error) {
+	f, err := os.Open(s.path(seq))
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	header := make([]byte, spoolMaxHeader)
+
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	chunk, _, err := parseSegment(header[:n])
+
+	return chunk, err
+}
+
+// remove deletes the segment once the message is delivered.
+func (s *spool) remove(seq uint64) {
+	s.forget(seq)
+
+	// message would be delivered once again after the restart if segment is not removed
+	_ = os.Remove(s.path(seq))
+}
+
+// quarantine moves the segment which can't be read out of the spool.
+func (s *spool) quarantine(seq uint64) {
+	s.forget(seq)
+
+	// if segment can't be renamed, it's retried after the restart
+	_ = os.Rename(s.path(seq), s.path(seq)+spoolBadExt)
+}
+
+// forget removes the segment from the spool size accounting.
+func (s *spool) forget(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, segment := range s.segments {
+		if segment.seq == seq {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.size -= segment.size
+
+			break
+		}
+	}
+}
+
+// parseSegment splits segment contents into the chunk id and the message.
+func parseSegment(contents []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(contents)
+	if n <= 0 || uint64(len(contents)-n) < l {
+		return "", nil, errCorruptedSegment
+	}
+
+	return string(contents[n : n+int(l)]), contents[n+int(l):], nil
+}
+
+// writeFileSync writes the file and syncs it to disk.
+func writeFileSync(path string, parts ...[]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if _, err = f.Write(part); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
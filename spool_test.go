@@ -0,0 +1,282 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	zapmsgpack "github.com/smira/zap-msgpack-encoder"
+)
+
+func spoolFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+
+	return files
+}
+
+func TestClientSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zapmsgpack")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	// fluentd is down
+	server := newFakeServer(t, "127.0.0.1:0")
+	address := server.Addr()
+	server.Close()
+
+	entries := encodeEntries(t, 3)
+
+	cfg := zapmsgpack.ClientConfig{
+		Address:       address,
+		Tag:           "app.test",
+		MinBackoff:    time.Millisecond,
+		MaxBufferSize: len(entries[0]) + 1,
+		RequireAck:    true,
+		SpoolDir:      dir,
+	}
+
+	client, err := zapmsgpack.NewClient(cfg)
+	require.NoError(t, err)
+
+	// entries are moved to the spool, so they don't fill the buffer
+	for _, entry := range entries {
+		_, err = client.Write(entry)
+		require.NoError(t, err)
+
+		assert.Error(t, client.Sync())
+	}
+
+	assert.Len(t, spoolFiles(t, dir), 3)
+
+	require.Error(t, client.Close())
+	assert.Len(t, spoolFiles(t, dir), 3)
+
+	// leftovers of the crash are ignored
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000007.seg.tmp"), []byte("partial"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000008.seg"), []byte{0xff}, 0600))
+
+	// restart with fluentd up
+	server = newFakeServer(t, address)
+	defer server.Close()
+
+	client, err = zapmsgpack.NewClient(cfg)
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	require.NoError(t, client.Sync())
+
+	messages := server.waitMessages(t, 3)
+	chunks := map[string]bool{}
+
+	for i, msg := range messages {
+		assert.Equal(t, expectedEntries(3)[i:i+1], msg.([]interface{})[1])
+
+		chunks[messageChunk(msg)] = true
+	}
+
+	assert.Len(t, chunks, 3)
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestClientSpoolEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zapmsgpack")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	server := newFakeServer(t, "127.0.0.1:0")
+	address := server.Addr()
+	server.Close()
+
+	entries := encodeEntries(t, 3)
+
+	client, err := zapmsgpack.NewClient(zapmsgpack.ClientConfig{
+		Address:       address,
+		Tag:           "app.test",
+		MinBackoff:    time.Millisecond,
+		SpoolDir:      dir,
+		SpoolMaxBytes: int64(2*len(entries[0]) + 64),
+	})
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	for _, entry := range entries {
+		_, err = client.Write(entry)
+		require.NoError(t, err)
+
+		assert.Error(t, client.Sync())
+	}
+
+	// oldest message is evicted
+	assert.Len(t, spoolFiles(t, dir), 2)
+
+	server = newFakeServer(t, address)
+	defer server.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, client.Sync())
+
+	messages := server.waitMessages(t, 2)
+	assert.Equal(t, expectedEntries(3)[1:2], messages[0].([]interface{})[1])
+	assert.Equal(t, expectedEntries(3)[2:], messages[1].([]interface{})[1])
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestClientSpoolWriteAhead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zapmsgpack")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	// fluentd receives the message, but crashes before the ack
+	server := newFakeServer(t, "127.0.0.1:0")
+	address := server.Addr()
+
+	server.mu.Lock()
+	server.skipAcks = 1
+	server.mu.Unlock()
+
+	cfg := zapmsgpack.ClientConfig{
+		Address:    address,
+		Tag:        "app.test",
+		RequireAck: true,
+		AckTimeout: 200 * time.Millisecond,
+		SpoolDir:   dir,
+	}
+
+	client, err := zapmsgpack.NewClient(cfg)
+	require.NoError(t, err)
+
+	_, err = client.Write(encodeEntries(t, 1)[0])
+	require.NoError(t, err)
+
+	synced := make(chan error)
+
+	go func() {
+		synced <- client.Sync()
+	}()
+
+	// message in flight is already on disk
+	messages := server.waitMessages(t, 1)
+	assert.Len(t, spoolFiles(t, dir), 1)
+
+	server.Close()
+
+	assert.Error(t, <-synced)
+	assert.Error(t, client.Close())
+
+	// restart
+	server = newFakeServer(t, address)
+	defer server.Close()
+
+	client, err = zapmsgpack.NewClient(cfg)
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	require.NoError(t, client.Sync())
+
+	retransmitted := server.waitMessages(t, 1)
+	assert.Equal(t, messages[0], retransmitted[0])
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestClientSpoolUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zapmsgpack")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	server := newFakeServer(t, "127.0.0.1:0")
+	address := server.Addr()
+	server.Close()
+
+	cfg := zapmsgpack.ClientConfig{
+		Address:    address,
+		Tag:        "app.test",
+		MinBackoff: time.Minute,
+		SpoolDir:   dir,
+	}
+
+	client, err := zapmsgpack.NewClient(cfg)
+	require.NoError(t, err)
+
+	entries := encodeEntries(t, 4)
+
+	for _, entry := range entries[:3] {
+		_, err = client.Write(entry)
+		require.NoError(t, err)
+
+		assert.Error(t, client.Sync())
+	}
+
+	require.Error(t, client.Close())
+
+	segments := spoolFiles(t, dir)
+	require.Len(t, segments, 3)
+
+	// directory can't be read as a segment, even by root
+	unreadable := func(path string) {
+		require.NoError(t, os.Remove(path))
+		require.NoError(t, os.Mkdir(path, 0700))
+	}
+
+	// unreadable segment doesn't prevent the client from starting
+	unreadable(segments[0])
+
+	server = newFakeServer(t, address)
+	defer server.Close()
+
+	client, err = zapmsgpack.NewClient(cfg)
+	require.NoError(t, err)
+
+	defer client.Close()
+
+	assert.Equal(t, []string{segments[0] + ".bad", segments[1], segments[2]}, spoolFiles(t, dir))
+
+	// segment becomes unreadable after the start, it's skipped with the error
+	unreadable(segments[1])
+
+	assert.Error(t, client.Sync())
+
+	messages := server.waitMessages(t, 1)
+	assert.Equal(t, expectedEntries(3)[2:], messages[0].([]interface{})[1])
+	assert.Equal(t, []string{segments[0] + ".bad", segments[1] + ".bad"}, spoolFiles(t, dir))
+
+	// endpoint is still healthy
+	_, err = client.Write(entries[3])
+	require.NoError(t, err)
+	require.NoError(t, client.Sync())
+
+	server.waitMessages(t, 2)
+}
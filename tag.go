@@ -0,0 +1,139 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// TagResolver resolves fluentd tag of the entry.
+//
+// Fluentd routes events based on the tag.
+type TagResolver interface {
+	ResolveTag(ent zapcore.Entry, fields []zapcore.Field) string
+}
+
+type staticTag string
+
+func (tag staticTag) ResolveTag(zapcore.Entry, []zapcore.Field) string {
+	return string(tag)
+}
+
+// StaticTag uses the same tag for all the entries.
+func StaticTag(tag string) TagResolver {
+	return staticTag(tag)
+}
+
+type loggerNameTag struct {
+	fallback string
+}
+
+func (tag loggerNameTag) ResolveTag(ent zapcore.Entry, _ []zapcore.Field) string {
+	if ent.LoggerName == "" {
+		return tag.fallback
+	}
+
+	return ent.LoggerName
+}
+
+// LoggerNameTag uses logger name as the tag, fallback is used for unnamed loggers.
+func LoggerNameTag(fallback string) TagResolver {
+	return loggerNameTag{fallback}
+}
+
+type fieldTag struct {
+	key      string
+	fallback string
+}
+
+func (tag fieldTag) ResolveTag(_ zapcore.Entry, fields []zapcore.Field) string {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Key == tag.key && fields[i].Type == zapcore.StringType {
+			return fields[i].String
+		}
+	}
+
+	return tag.fallback
+}
+
+func (tag fieldTag) tagKey() string {
+	return tag.key
+}
+
+// FieldTag uses value of the string field with the key as the tag, fallback
+// is used if there's no such field.
+//
+// In message mode the field is pulled out of the record. Top-level fields
+// added with With are looked up as well, fields passed with the entry take
+// precedence.
+func FieldTag(key, fallback string) TagResolver {
+	return fieldTag{key, fallback}
+}
+
+type prefixTag struct {
+	prefix string
+	tag    TagResolver
+}
+
+func (tag prefixTag) ResolveTag(ent zapcore.Entry, fields []zapcore.Field) string {
+	resolved := tag.tag.ResolveTag(ent, fields)
+	if resolved == "" {
+		return strings.TrimSuffix(tag.prefix, ".")
+	}
+
+	return tag.prefix + resolved
+}
+
+func (tag prefixTag) tagKey() string {
+	return tagKey(tag.tag)
+}
+
+// PrefixTag prepends the prefix to the tag resolved by another resolver.
+//
+// E.g. PrefixTag("app.", LoggerNameTag("")) resolves to "app.db.pool" for the
+// logger named "db.pool" and to "app" for unnamed loggers.
+func PrefixTag(prefix string, tag TagResolver) TagResolver {
+	return prefixTag{prefix, tag}
+}
+
+// TagFunc is an adapter to use ordinary function as TagResolver.
+type TagFunc func(ent zapcore.Entry, fields []zapcore.Field) string
+
+// ResolveTag calls f(ent, fields).
+func (f TagFunc) ResolveTag(ent zapcore.Entry, fields []zapcore.Field) string {
+	return f(ent, fields)
+}
+
+// tagKeyer is implemented by resolvers which take the tag from the field.
+type tagKeyer interface {
+	tagKey() string
+}
+
+// tagKey returns the key of the field which is pulled out of the record into the tag.
+func tagKey(tag TagResolver) string {
+	if keyer, ok := tag.(tagKeyer); ok {
+		return keyer.tagKey()
+	}
+
+	return ""
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2019 Andrey Smirnov
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zapmsgpack
+
+import (
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// eventTimeExt is the msgpack extension type of fluentd EventTime.
+const eventTimeExt = 0
+
+// EventTimeEncoder serializes a time.Time as fluentd EventTime msgpack
+// extension (type 0): seconds and nanoseconds as big-endian uint32 values.
+//
+// EventTime is the only timestamp representation which preserves sub-second
+// precision in fluentd forward protocol:
+// https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1#eventtime-ext-format
+//
+// Encoders other than msgpack one get floating-point epoch seconds.
+func EventTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	menc, ok := enc.(*encoder)
+	if !ok {
+		zapcore.EpochTimeEncoder(t, enc)
+		return
+	}
+
+	menc.sliceLen++
+	menc.write(appendEventTime(menc.scratch[:0], t))
+}
+
+// TimestampTimeEncoder serializes a time.Time as msgpack timestamp extension (type -1).
+//
+// Encoders other than msgpack one get RFC3339 string with nanoseconds.
+func TimestampTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	menc, ok := enc.(*encoder)
+	if !ok {
+		RFC3339NanoTimeEncoder(t, enc)
+		return
+	}
+
+	menc.sliceLen++
+	menc.write(appendTimestamp(menc.scratch[:0], t))
+}
+
+// EpochSecondsTimeEncoder serializes a time.Time as an integer number of seconds
+// since the Unix epoch.
+//
+// This is the plain timestamp representation in fluentd forward protocol.
+func EpochSecondsTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	enc.AppendInt64(t.Unix())
+}
+
+// EpochFloatTimeEncoder serializes a time.Time as a floating-point number of seconds
+// since the Unix epoch.
+func EpochFloatTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	enc.AppendFloat64(float64(t.UnixNano()) / float64(time.Second))
+}
+
+// EpochMillisTimeEncoder serializes a time.Time as an integer number of milliseconds
+// since the Unix epoch.
+func EpochMillisTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	enc.AppendInt64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// EpochNanosTimeEncoder serializes a time.Time as an integer number of nanoseconds
+// since the Unix epoch.
+func EpochNanosTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	enc.AppendInt64(t.UnixNano())
+}
+
+// RFC3339TimeEncoder serializes a time.Time to an RFC3339-formatted string.
+func RFC3339TimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	enc.AppendString(t.Format(time.RFC3339))
+}
+
+// RFC3339NanoTimeEncoder serializes a time.Time to an RFC3339-formatted string
+// with nanosecond precision.
+func RFC3339NanoTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+	enc.AppendString(t.Format(time.RFC3339Nano))
+}